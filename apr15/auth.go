@@ -0,0 +1,86 @@
+package main
+
+import (
+        "crypto/ed25519"
+        "io"
+)
+
+// authContext is signed along with the ephemeral keys of a connection.
+var authContext = []byte("whispering gophers auth")
+
+// authMsgLen is the size of the message proving an identity.
+const authMsgLen = ed25519.PublicKeySize + ed25519.SignatureSize
+
+// authConfig holds the long-term identity authenticating the ephemeral key
+// of a connection, and decides which peer identities are accepted.
+type authConfig struct {
+        identity  ed25519.PrivateKey
+        authorize func(peer *[32]byte) bool // nil accepts any peer
+}
+
+func newAuthConfig(identity *[32]byte, authorize func(peer *[32]byte) bool) *authConfig {
+        return &authConfig{
+                identity:  ed25519.NewKeyFromSeed(identity[:]),
+                authorize: authorize,
+        }
+}
+
+// GenerateIdentity generates a long-term identity key pair for DialAuth
+// and Server.Identity. The private key is an Ed25519 seed.
+func GenerateIdentity(random io.Reader) (pub, priv *[32]byte, err error) {
+        priv = new([32]byte)
+        if _, err := io.ReadFull(random, priv[:]); err != nil {
+                return nil, nil, err
+        }
+        return IdentityPublicKey(priv), priv, nil
+}
+
+// IdentityPublicKey returns the public key of the identity private key.
+func IdentityPublicKey(identity *[32]byte) *[32]byte {
+        pub := new([32]byte)
+        copy(pub[:], ed25519.NewKeyFromSeed(identity[:]).Public().(ed25519.PublicKey))
+        return pub
+}
+
+// authMessage returns what the owner of the ephemeral key signer signs to
+// authenticate it to the owner of verifier.
+func authMessage(signer, verifier *[32]byte) []byte {
+        msg := append([]byte(nil), authContext...)
+        msg = append(msg, signer[:]...)
+        return append(msg, verifier[:]...)
+}
+
+// send proves our identity to the peer of c. It bypasses the byte counters
+// of c.
+func (a *authConfig) send(c *secureConn) error {
+        msg := make([]byte, 0, authMsgLen)
+        msg = append(msg, a.identity.Public().(ed25519.PublicKey)...)
+        msg = append(msg, ed25519.Sign(a.identity, authMessage(&c.pub, &c.peerPub))...)
+        if _, err := c.ReadWriter.Write(msg); err != nil {
+                return &HandshakeError{stageAuth, err}
+        }
+        return nil
+}
+
+// receive checks the identity of the peer of c and records it. It bypasses
+// the byte counters of c.
+func (a *authConfig) receive(c *secureConn) error {
+        msg := make([]byte, authMsgLen)
+        if _, err := io.ReadFull(c.ReadWriter, msg); err != nil {
+                if err == io.EOF {
+                        err = io.ErrUnexpectedEOF
+                }
+                return &HandshakeError{stageAuth, err}
+        }
+        peer := new([32]byte)
+        copy(peer[:], msg)
+        sig := msg[ed25519.PublicKeySize:]
+        if !ed25519.Verify(peer[:], authMessage(&c.peerPub, &c.pub), sig) {
+                return &HandshakeError{stageAuth, ErrBadHandshake}
+        }
+        if a.authorize != nil && !a.authorize(peer) {
+                return &HandshakeError{stageAuth, ErrBadHandshake}
+        }
+        c.peerIdentity = peer
+        return nil
+}
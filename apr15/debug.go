@@ -0,0 +1,67 @@
+package main
+
+// EventKind identifies a debugging event.
+type EventKind int
+
+// Events reported to DebugLogger.
+const (
+        EventHandshakeStart EventKind = iota
+        EventProtocolMismatch
+        EventKeyReceived
+        EventFrameWritten
+        EventFrameRead
+        EventDecryptionError
+        EventInsecureFallback
+)
+
+var eventNames = [...]string{
+        EventHandshakeStart:   "handshake started",
+        EventProtocolMismatch: "protocol mismatch",
+        EventKeyReceived:      "key received",
+        EventFrameWritten:     "frame written",
+        EventFrameRead:        "frame read",
+        EventDecryptionError:  "decryption error",
+        EventInsecureFallback: "insecure fallback",
+}
+
+func (k EventKind) String() string {
+        if k < 0 || int(k) >= len(eventNames) {
+                return "unknown event"
+        }
+        return eventNames[k]
+}
+
+// Event is a handshake or framing event.
+type Event struct {
+        Kind EventKind
+
+        // Size is the size of the frame on the wire for frame events.
+        Size int
+}
+
+// Logger receives debugging events.
+type Logger interface {
+        Log(e Event)
+}
+
+// LoggerFunc adapts a function to a Logger.
+type LoggerFunc func(e Event)
+
+// Log calls f(e).
+func (f LoggerFunc) Log(e Event) { f(e) }
+
+// DebugLogger receives the handshake and framing events of every
+// connection, reader and writer when not nil, unless they have a logger of
+// their own, such as Dialer.Logger. It is meant for diagnosing
+// interoperability problems and must be set before use.
+var DebugLogger Logger
+
+// logEvent reports an event to l, or to DebugLogger if l is nil.
+func logEvent(l Logger, kind EventKind, size int) {
+        if l == nil {
+                l = DebugLogger
+        }
+        if l != nil {
+                l.Log(Event{Kind: kind, Size: size})
+        }
+}
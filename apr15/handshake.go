@@ -0,0 +1,300 @@
+package main
+
+import (
+        "bytes"
+        "errors"
+        "io"
+        "net"
+        "time"
+)
+
+// DefaultHandshakeTimeout is the time allowed to complete a handshake
+// unless configured otherwise.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+var (
+        // protocolHandshake is sent by the client to announce the protocol.
+        protocolHandshake = []byte("whispering gophers 1")
+
+        // negotiateHandshake is sent by the client instead of
+        // protocolHandshake to offer a list of protocol versions.
+        negotiateHandshake = []byte("whispering gophers ?")
+
+        // badHandshakeResponse is sent by the server when it doesn't speak
+        // any of the protocol versions offered by the client.
+        badHandshakeResponse = []byte("bad handshake")
+
+        // errProtocolMismatch is the cause of the HandshakeError returned
+        // by the client when the server doesn't speak the protocol, the
+        // only failure Dialer.InsecureFallback falls back on.
+        errProtocolMismatch = errors.New("server doesn't speak the protocol")
+
+        // protocolVersions lists the protocol versions we speak, in order of
+        // preference. Every version is at most 255 bytes long.
+        protocolVersions = [][]byte{protocolHandshake}
+)
+
+// Handshake stages reported by HandshakeError.
+const (
+        stageSendHello   = "send-hello"
+        stageRecvHello   = "recv-hello"
+        stageRecvVersion = "recv-version"
+        stageRecvKey     = "recv-key"
+        stageSendKey     = "send-key"
+        stageAuth        = "auth"
+)
+
+// HandshakeError records a failed handshake and the stage it failed at.
+// It matches ErrBadHandshake with errors.Is.
+type HandshakeError struct {
+        Stage string
+        Err   error
+}
+
+func (e *HandshakeError) Error() string {
+        return "handshake " + e.Stage + ": " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+func (e *HandshakeError) Is(target error) bool { return target == ErrBadHandshake }
+
+// writeFull writes all of b to w, returning the number of bytes written
+// before any error.
+func writeFull(w io.Writer, b []byte) (int, error) {
+        written := 0
+        for written < len(b) {
+                n, err := w.Write(b[written:])
+                written += n
+                if err != nil {
+                        return written, err
+                }
+                if n == 0 {
+                        return written, io.ErrShortWrite
+                }
+        }
+        return written, nil
+}
+
+// receiveKey reads a public key from r.
+func receiveKey(r io.Reader) (*[32]byte, error) {
+        key := new([32]byte)
+        if _, err := io.ReadFull(r, key[:]); err != nil {
+                if err == io.EOF {
+                        err = io.ErrUnexpectedEOF
+                }
+                return nil, err
+        }
+        return key, nil
+}
+
+// isWeakKey reports whether key is the all-zero key, which is never sent
+// by a working peer.
+func isWeakKey(key *[32]byte) bool {
+        var zero [32]byte
+        return *key == zero
+}
+
+// clientHandshake offers versions, sends pub and returns the server public
+// key and the version it chose.
+//
+// Offering only protocolHandshake sends it as is, followed by the key. Any
+// other offer is sent as negotiateHandshake, a count byte and the
+// length-prefixed versions, followed by the key; the server then replies
+// with the length-prefixed version it chose before its key.
+//
+// The whole hello is sent in a single write so the server can receive it
+// in one read.
+func clientHandshake(c net.Conn, pub *[32]byte, versions [][]byte, logger Logger) (*[32]byte, []byte, error) {
+        logEvent(logger, EventHandshakeStart, 0)
+        legacy := len(versions) == 1 && bytes.Equal(versions[0], protocolHandshake)
+
+        var hello []byte
+        if legacy {
+                hello = append(hello, protocolHandshake...)
+        } else {
+                hello = append(hello, negotiateHandshake...)
+                hello = append(hello, byte(len(versions)))
+                for _, v := range versions {
+                        hello = append(hello, byte(len(v)))
+                        hello = append(hello, v...)
+                }
+        }
+        hello = append(hello, pub[:]...)
+        if n, err := writeFull(c, hello); err != nil {
+                // Tell a failure sending the key from one sending the rest.
+                stage := stageSendHello
+                if n >= len(hello)-len(pub) {
+                        stage = stageSendKey
+                }
+                return nil, nil, &HandshakeError{stage, err}
+        }
+
+        stage := stageRecvKey
+        if !legacy {
+                stage = stageRecvVersion
+        }
+        // Any reply of ours is longer than badHandshakeResponse, which
+        // servers not speaking our versions answer with.
+        head := make([]byte, len(badHandshakeResponse))
+        if _, err := io.ReadFull(c, head); err != nil {
+                if err == io.EOF {
+                        err = io.ErrUnexpectedEOF
+                }
+                return nil, nil, &HandshakeError{stage, err}
+        }
+        if bytes.Equal(head, badHandshakeResponse) {
+                logEvent(logger, EventProtocolMismatch, 0)
+                return nil, nil, &HandshakeError{stage, errProtocolMismatch}
+        }
+        r := io.MultiReader(bytes.NewReader(head), c)
+
+        version := protocolHandshake
+        if !legacy {
+                v, err := readVersion(r)
+                if err != nil {
+                        return nil, nil, &HandshakeError{stageRecvVersion, err}
+                }
+                if !containsVersion(versions, v) {
+                        logEvent(logger, EventProtocolMismatch, 0)
+                        return nil, nil, &HandshakeError{stageRecvVersion, errProtocolMismatch}
+                }
+                version = v
+        }
+
+        key, err := receiveKey(r)
+        if err != nil {
+                return nil, nil, &HandshakeError{stageRecvKey, err}
+        }
+        logEvent(logger, EventKeyReceived, 0)
+        if isWeakKey(key) {
+                return nil, nil, &HandshakeError{stageRecvKey, ErrBadHandshake}
+        }
+        return key, version, nil
+}
+
+// serverHandshake checks the client protocol, sends pub and returns the
+// client public key and the negotiated version. The whole client hello is
+// read before replying. It is laid out as:
+//
+//	legacy:    protocolHandshake (20) | key (32)
+//	negotiate: negotiateHandshake (20) | count (1) |
+//	           count * (length (1) | version) | key (32)
+//
+// The hello is read however the transport splits it, so clients may send
+// it in several writes.
+func serverHandshake(c net.Conn, pub *[32]byte, logger Logger) (*[32]byte, []byte, error) {
+        logEvent(logger, EventHandshakeStart, 0)
+        hello, err := readHello(c)
+        if err == ErrBadHandshake {
+                logEvent(logger, EventProtocolMismatch, 0)
+                writeFull(c, badHandshakeResponse)
+        }
+        if err != nil {
+                return nil, nil, &HandshakeError{stageRecvHello, err}
+        }
+        legacy := bytes.Equal(hello, protocolHandshake)
+
+        offered := [][]byte{protocolHandshake}
+        if !legacy {
+                if offered, err = readVersions(c); err != nil {
+                        return nil, nil, &HandshakeError{stageRecvHello, err}
+                }
+        }
+        key, err := receiveKey(c)
+        if err != nil {
+                return nil, nil, &HandshakeError{stageRecvKey, err}
+        }
+        logEvent(logger, EventKeyReceived, 0)
+        if isWeakKey(key) {
+                writeFull(c, badHandshakeResponse)
+                return nil, nil, &HandshakeError{stageRecvKey, ErrBadHandshake}
+        }
+
+        var version []byte
+        for _, v := range offered {
+                if containsVersion(protocolVersions, v) {
+                        version = v
+                        break
+                }
+        }
+        if version == nil {
+                logEvent(logger, EventProtocolMismatch, 0)
+                writeFull(c, badHandshakeResponse)
+                return nil, nil, &HandshakeError{stageRecvHello, ErrBadHandshake}
+        }
+
+        var reply []byte
+        if !legacy {
+                reply = append(reply, byte(len(version)))
+                reply = append(reply, version...)
+        }
+        reply = append(reply, pub[:]...)
+        if _, err := writeFull(c, reply); err != nil {
+                return nil, nil, &HandshakeError{stageSendKey, err}
+        }
+        return key, version, nil
+}
+
+// readHello reads the protocolHandshake or negotiateHandshake starting a
+// client hello. It fails with ErrBadHandshake as soon as the bytes read
+// can't start either, without waiting for the rest.
+func readHello(r io.Reader) ([]byte, error) {
+        hello := make([]byte, len(protocolHandshake))
+        read := 0
+        for read < len(hello) {
+                n, err := r.Read(hello[read:])
+                read += n
+                if !bytes.HasPrefix(protocolHandshake, hello[:read]) &&
+                        !bytes.HasPrefix(negotiateHandshake, hello[:read]) {
+                        return nil, ErrBadHandshake
+                }
+                if err != nil && read < len(hello) {
+                        if err == io.EOF && read > 0 {
+                                err = io.ErrUnexpectedEOF
+                        }
+                        return nil, err
+                }
+        }
+        return hello, nil
+}
+
+// readVersion reads a length-prefixed version.
+func readVersion(r io.Reader) ([]byte, error) {
+        var l [1]byte
+        if _, err := io.ReadFull(r, l[:]); err != nil {
+                return nil, err
+        }
+        v := make([]byte, l[0])
+        if _, err := io.ReadFull(r, v); err != nil {
+                return nil, err
+        }
+        return v, nil
+}
+
+// readVersions reads a count byte followed by as many length-prefixed
+// versions.
+func readVersions(r io.Reader) ([][]byte, error) {
+        var count [1]byte
+        if _, err := io.ReadFull(r, count[:]); err != nil {
+                return nil, err
+        }
+        versions := make([][]byte, count[0])
+        for i := range versions {
+                v, err := readVersion(r)
+                if err != nil {
+                        return nil, err
+                }
+                versions[i] = v
+        }
+        return versions, nil
+}
+
+func containsVersion(versions [][]byte, v []byte) bool {
+        for _, w := range versions {
+                if bytes.Equal(w, v) {
+                        return true
+                }
+        }
+        return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+        "crypto/sha256"
+        "encoding/hex"
+        "encoding/pem"
+        "errors"
+        "io"
+        "io/ioutil"
+        "strings"
+
+        "golang.org/x/crypto/curve25519"
+)
+
+// pemKeyType is the PEM block type used by WriteKeyPEM.
+const pemKeyType = "BOX PRIVATE KEY"
+
+// ErrInvalidKey is returned when a serialized key can't be decoded to
+// exactly 32 bytes, or when a key pair doesn't match.
+var ErrInvalidKey = errors.New("invalid key")
+
+// publicKey returns the public key of priv.
+func publicKey(priv *[32]byte) (*[32]byte, error) {
+        derived, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+        if err != nil {
+                return nil, ErrInvalidKey
+        }
+        pub := new([32]byte)
+        copy(pub[:], derived)
+        return pub, nil
+}
+
+// EncodeKey returns the hex encoding of k.
+func EncodeKey(k *[32]byte) string {
+        return hex.EncodeToString(k[:])
+}
+
+// DecodeKey decodes a key encoded by EncodeKey.
+func DecodeKey(s string) (*[32]byte, error) {
+        b, err := hex.DecodeString(s)
+        if err != nil || len(b) != 32 {
+                return nil, ErrInvalidKey
+        }
+        k := new([32]byte)
+        copy(k[:], b)
+        return k, nil
+}
+
+// fingerprintLen is the number of hash bytes kept by Fingerprint.
+const fingerprintLen = 16
+
+// Fingerprint returns a short identifier for pub suitable for comparing
+// keys by eye: the first 16 bytes of its SHA-256 hash as colon separated
+// hex, e.g. "3b:a1:...".
+func Fingerprint(pub *[32]byte) string {
+        sum := sha256.Sum256(pub[:])
+        groups := make([]string, fingerprintLen)
+        for i := range groups {
+                groups[i] = hex.EncodeToString(sum[i : i+1])
+        }
+        return strings.Join(groups, ":")
+}
+
+// WriteKeyPEM writes priv to w as a PEM block.
+func WriteKeyPEM(w io.Writer, priv *[32]byte) error {
+        return pem.Encode(w, &pem.Block{Type: pemKeyType, Bytes: priv[:]})
+}
+
+// ReadKeyPEM reads a key written by WriteKeyPEM.
+func ReadKeyPEM(r io.Reader) (*[32]byte, error) {
+        data, err := ioutil.ReadAll(r)
+        if err != nil {
+                return nil, err
+        }
+        b, _ := pem.Decode(data)
+        if b == nil || b.Type != pemKeyType || len(b.Bytes) != 32 {
+                return nil, ErrInvalidKey
+        }
+        k := new([32]byte)
+        copy(k[:], b.Bytes)
+        return k, nil
+}
@@ -157,7 +157,7 @@ func TestSecureDial(t *testing.T) {
                         }
                         go func(c net.Conn) {
                                 defer c.Close()
-                                key := [32]byte{}
+                                key := [32]byte{'k', 'e', 'y'}
                                 c.Write(key[:])
                                 buf := make([]byte, 2048)
                                 n, err := c.Read(buf)
@@ -0,0 +1,2712 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/rand"
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "net"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+
+        "golang.org/x/crypto/curve25519"
+        "golang.org/x/crypto/nacl/box"
+)
+
+func TestMoreShortMessage(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        if n, err := secureW.Write(nil); n != 0 || err != nil {
+                t.Fatalf("Unexpected result writing an empty message: %d, %v", n, err)
+        }
+        if buf.Len() != 0 {
+                t.Fatalf("Empty message produced %d bytes on the wire", buf.Len())
+        }
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        if n, err := secureR.Read(nil); n != 0 || err != nil {
+                t.Fatalf("Unexpected result reading into an empty buffer: %d, %v", n, err)
+        }
+}
+
+func TestMoreLongMessage(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        r, w := io.Pipe()
+        defer w.Close()
+        secureR := NewSecureReader(r, priv, pub)
+        secureW := NewSecureWriter(w, priv, pub)
+
+        expected := bytes.Repeat([]byte{'g'}, MaxMsgLen)
+        go secureW.Write(expected)
+
+        buf := make([]byte, 2*MaxMsgLen)
+        n, err := secureR.Read(buf)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !bytes.Equal(buf[:n], expected) {
+                t.Fatalf("Unexpected result: got %d bytes, expected %d", n, len(expected))
+        }
+}
+
+func TestMoreHugeMessage(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        if _, err := secureW.Write(make([]byte, MaxMsgLen+1)); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+        if buf.Len() != 0 {
+                t.Fatalf("Rejected message produced %d bytes on the wire", buf.Len())
+        }
+}
+
+func TestMoreWriteAll(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        msg := make([]byte, 2*MaxMsgLen+1)
+        rand.Read(msg)
+        var buf bytes.Buffer
+        n, err := NewSecureWriter(&buf, priv, pub).WriteAll(msg)
+        if err != nil || n != len(msg) {
+                t.Fatalf("Unexpected result: got %d, %v, expected %d", n, err, len(msg))
+        }
+        if buf.Len() != len(msg)+3*MsgOverhead {
+                t.Fatalf("Unexpected length: got %d, expected 3 frames for %d bytes", buf.Len(), len(msg))
+        }
+        got, err := ioutil.ReadAll(NewSecureReader(&buf, priv, pub))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !bytes.Equal(got, msg) {
+                t.Fatal("Unexpected result")
+        }
+}
+
+func TestMoreReadClosedWriter(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        r, w := io.Pipe()
+        secureR := NewSecureReader(r, priv, pub)
+        w.Close()
+
+        buf := make([]byte, 1024)
+        if _, err := secureR.Read(buf); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMoreReaderDecryptionError(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        fmt.Fprint(secureW, "hello world\n")
+
+        // Flip a bit of the nonce.
+        frame := buf.Bytes()
+        frame[HeaderLen] ^= 1
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        if _, err := secureR.Read(make([]byte, 1024)); !errors.Is(err, ErrDecryptionError) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrDecryptionError)
+        }
+}
+
+func TestMoreDecryptionErrorPosition(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        fmt.Fprint(secureW, "hello world\n")
+        first := buf.Len()
+        fmt.Fprint(secureW, "hello again\n")
+
+        // Flip a bit of the second frame's nonce.
+        buf.Bytes()[first+HeaderLen] ^= 1
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        got := make([]byte, 1024)
+        if _, err := secureR.Read(got); err != nil {
+                t.Fatal(err)
+        }
+        _, err := secureR.Read(got)
+        derr, ok := err.(*DecryptionError)
+        if !ok {
+                t.Fatalf("Unexpected error: got %v, expected a *DecryptionError", err)
+        }
+        if derr.Frame != 1 || derr.Offset != int64(first) {
+                t.Fatalf("Unexpected position: got frame %d at %d, expected frame 1 at %d", derr.Frame, derr.Offset, first)
+        }
+        if !errors.Is(err, ErrDecryptionError) {
+                t.Fatalf("%v doesn't match ErrDecryptionError", err)
+        }
+}
+
+func TestMoreSkipCorruptFrame(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        fmt.Fprint(secureW, "one ")
+        first := buf.Len()
+        fmt.Fprint(secureW, "two ")
+        fmt.Fprint(secureW, "three")
+
+        // Flip a bit of the second frame's box.
+        buf.Bytes()[2*first-1] ^= 1
+
+        var skipped []*DecryptionError
+        secureR := NewSecureReader(&buf, priv, pub)
+        secureR.SetCorruptFrameHandler(func(err *DecryptionError) {
+                skipped = append(skipped, err)
+        })
+        got, err := ioutil.ReadAll(secureR)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got) != "one three" {
+                t.Fatalf("Unexpected result: got %q, expected %q", got, "one three")
+        }
+        if len(skipped) != 1 || skipped[0].Frame != 1 || skipped[0].Offset != int64(first) {
+                t.Fatalf("Unexpected skipped frames: %v", skipped)
+        }
+}
+
+// halfWriter accepts half of every write without an error.
+type halfWriter struct{ bytes.Buffer }
+
+func (w *halfWriter) Write(p []byte) (int, error) {
+        return w.Buffer.Write(p[:len(p)/2])
+}
+
+func TestMoreShortWrite(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        secureW := NewSecureWriter(new(halfWriter), priv, pub)
+        if _, err := secureW.Write([]byte("hello world\n")); err != io.ErrShortWrite {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.ErrShortWrite)
+        }
+}
+
+// slowReader returns a byte per read, after a delay.
+type slowReader struct {
+        r     io.Reader
+        delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+        time.Sleep(r.delay)
+        return r.r.Read(p[:1])
+}
+
+func TestMoreMinRate(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        fmt.Fprint(NewSecureWriter(&buf, priv, pub), "hello world\n")
+        frame := buf.Bytes()
+
+        secureR := NewSecureReader(bytes.NewReader(frame), priv, pub)
+        secureR.SetMinRate(1000, 10*time.Millisecond)
+        if _, err := secureR.Read(make([]byte, 1024)); err != nil {
+                t.Fatal(err)
+        }
+
+        // 200 bytes per second.
+        secureR = NewSecureReader(slowReader{bytes.NewReader(frame), 5 * time.Millisecond}, priv, pub)
+        secureR.SetMinRate(1000, 10*time.Millisecond)
+        _, err := secureR.Read(make([]byte, 1024))
+        if err != ErrSlowFrame {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrSlowFrame)
+        }
+        if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+                t.Fatalf("%v isn't a timeout", err)
+        }
+
+        // A frame stalled within a single read is cut off by the deadline.
+        client, server := net.Pipe()
+        defer client.Close()
+        defer server.Close()
+        go client.Write(frame[:HeaderLen+NonceLen+1])
+        secureR = NewSecureReader(server, priv, pub)
+        secureR.SetMinRate(1000, 10*time.Millisecond)
+        errc := make(chan error, 1)
+        go func() {
+                _, err := secureR.Read(make([]byte, 1024))
+                errc <- err
+        }()
+        select {
+        case err := <-errc:
+                if err != ErrSlowFrame {
+                        t.Fatalf("Unexpected error: got %v, expected %v", err, ErrSlowFrame)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("The stalled frame wasn't cut off")
+        }
+
+        // The deadline of the caller still applies after a frame.
+        client2, server2 := net.Pipe()
+        defer client2.Close()
+        defer server2.Close()
+        go client2.Write(frame)
+        secureR = NewSecureReader(server2, priv, pub)
+        secureR.SetMinRate(1000, 10*time.Millisecond)
+        server2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+        if _, err := secureR.Read(make([]byte, 1024)); err != nil {
+                t.Fatal(err)
+        }
+        go func() {
+                _, err := secureR.Read(make([]byte, 1024))
+                errc <- err
+        }()
+        select {
+        case err := <-errc:
+                if ne, ok := err.(net.Error); !ok || !ne.Timeout() || err == ErrSlowFrame {
+                        t.Fatalf("Unexpected error: got %v, expected the deadline of the caller", err)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("The deadline of the caller was cleared")
+        }
+}
+
+func TestMoreSecureWriter(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var nonce [NonceLen]byte
+        copy(nonce[:], "a deterministic nonce...")
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriterRand(&buf, priv, pub, bytes.NewReader(nonce[:]))
+        fmt.Fprint(secureW, "hello world\n")
+
+        expected := []byte{frameVersion, 0, 0, 0, byte(len("hello world\n") + BoxOverhead)}
+        expected = append(expected, nonce[:]...)
+        sealed := sealNonce(nonce, frameVersion, 0)
+        expected = box.Seal(expected, []byte("hello world\n"), &sealed, pub, priv)
+        if !bytes.Equal(buf.Bytes(), expected) {
+                t.Fatalf("Unexpected frame: got %x, expected %x", buf.Bytes(), expected)
+        }
+
+        wire := new(frameRecorder)
+        AssertCiphertextUnique(t, NewSecureWriter(wire, priv, pub), wire, []byte("hello world\n"), 100)
+        wire = new(frameRecorder)
+        AssertCiphertextUnique(t, NewSecureWriterCounter(wire, priv, pub, 0), wire, []byte("hello world\n"), 100)
+}
+
+// frameRecorder keeps every write as a frame, SecureWriter writing each
+// frame at once.
+type frameRecorder struct {
+        frames [][]byte
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+        r.frames = append(r.frames, append([]byte(nil), p...))
+        return len(p), nil
+}
+
+// AssertCiphertextUnique writes plaintext n times with w, which writes
+// to wire, and fails t unless every frame written differs from the
+// others.
+func AssertCiphertextUnique(t *testing.T, w *SecureWriter, wire *frameRecorder, plaintext []byte, n int) {
+        t.Helper()
+        start := len(wire.frames)
+        for i := 0; i < n; i++ {
+                if _, err := w.Write(plaintext); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        seen := make(map[string]bool, n)
+        for _, frame := range wire.frames[start:] {
+                seen[string(frame)] = true
+        }
+        if len(wire.frames)-start != n {
+                t.Fatalf("Unexpected result. %d frames were written for %d messages.", len(wire.frames)-start, n)
+        }
+        if len(seen) != n {
+                t.Fatalf("Unexpected result. Only %d of %d encrypted messages are unique.", len(seen), n)
+        }
+}
+
+func TestMoreSecureReadWriter(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        rw := NewSecureReadWriter(&buf, priv, pub)
+
+        expected := "hello world\n"
+        if _, err := fmt.Fprint(rw, expected); err != nil {
+                t.Fatal(err)
+        }
+        if buf.String() == expected {
+                t.Fatal("Unexpected result. The message is not encrypted.")
+        }
+
+        got := make([]byte, 1024)
+        n, err := rw.Read(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+}
+
+func TestMoreSecureEchoServer(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        go Serve(l)
+
+        conn, err := Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        buf := make([]byte, MaxMsgLen)
+        for i := 0; i < 10; i++ {
+                expected := fmt.Sprintf("hello world %d\n", i)
+                if _, err := fmt.Fprint(conn, expected); err != nil {
+                        t.Fatal(err)
+                }
+                n, err := conn.Read(buf)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if got := string(buf[:n]); got != expected {
+                        t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+                }
+        }
+}
+
+func TestMoreBadHandshake(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        go func() {
+                conn, err := l.Accept()
+                if err != nil {
+                        return
+                }
+                conn.Write(badHandshakeResponse)
+                conn.Close()
+        }()
+
+        _, err = Dial(l.Addr().String())
+        if !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+        var herr *HandshakeError
+        if !errors.As(err, &herr) || herr.Stage != stageRecvKey {
+                t.Fatalf("Unexpected error: got %#v, expected a failure receiving the key", err)
+        }
+}
+
+func TestMoreDialContextTimeout(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        // Accept connections but never answer the handshake.
+        go func() {
+                for {
+                        conn, err := l.Accept()
+                        if err != nil {
+                                return
+                        }
+                        defer conn.Close()
+                }
+        }()
+
+        ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+        defer cancel()
+        if _, err := DialContext(ctx, l.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, context.DeadlineExceeded)
+        }
+}
+
+func TestMoreDialContextCancel(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        ctx, cancel := context.WithCancel(context.Background())
+        go func() {
+                conn, err := l.Accept()
+                if err != nil {
+                        return
+                }
+                defer conn.Close()
+                cancel()
+                time.Sleep(time.Second)
+        }()
+
+        if _, err := DialContext(ctx, l.Addr().String()); !errors.Is(err, context.Canceled) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, context.Canceled)
+        }
+}
+
+func TestMoreWrapClientCancelled(t *testing.T) {
+        client, server := net.Pipe()
+        defer client.Close()
+        defer server.Close()
+
+        // The handshake deadline must not override the cancellation.
+        ctx, cancel := context.WithCancel(context.Background())
+        cancel()
+        cfg := defaultDialConfig()
+        cfg.timeout = time.Minute
+        errc := make(chan error, 1)
+        go func() {
+                _, err := wrapClient(ctx, client, cfg)
+                errc <- err
+        }()
+        select {
+        case err := <-errc:
+                if err != context.Canceled {
+                        t.Fatalf("Unexpected error: got %v, expected %v", err, context.Canceled)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("The cancelled handshake didn't stop")
+        }
+}
+
+func TestMoreFailedWrapDeadline(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+        cfg := defaultDialConfig()
+        cfg.timeout = 50 * time.Millisecond
+        wraps := []struct {
+                side string
+                wrap func(net.Conn) (Conn, error)
+                fail func(peer net.Conn) // fails the handshake
+        }{
+                {
+                        "client",
+                        func(c net.Conn) (Conn, error) { return wrapClient(context.Background(), c, cfg) },
+                        func(peer net.Conn) {
+                                io.ReadFull(peer, make([]byte, len(protocolHandshake)+32))
+                                peer.Write(make([]byte, 32)) // weak key
+                        },
+                },
+                {
+                        "server",
+                        func(c net.Conn) (Conn, error) {
+                                return wrapServer(c, priv, pub, nil, cfg.timeout, rand.Reader, nil)
+                        },
+                        func(peer net.Conn) {
+                                peer.Write([]byte("not the right hello!"))
+                                io.ReadFull(peer, make([]byte, len(badHandshakeResponse)))
+                        },
+                },
+        }
+        for _, w := range wraps {
+                c, peer := net.Pipe()
+                go func() {
+                        w.fail(peer)
+                        // Outlive the handshake deadline.
+                        time.Sleep(2 * cfg.timeout)
+                        peer.Write([]byte("after"))
+                }()
+                if _, err := w.wrap(c); !errors.Is(err, ErrBadHandshake) {
+                        t.Fatalf("%s: unexpected error: got %v, expected %v", w.side, err, ErrBadHandshake)
+                }
+                got := make([]byte, 5)
+                if _, err := io.ReadFull(c, got); err != nil || string(got) != "after" {
+                        t.Fatalf("%s: unexpected result: got %q, %v", w.side, got, err)
+                }
+                c.Close()
+                peer.Close()
+        }
+}
+
+func TestMoreMessageSize(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriterSize(&buf, priv, pub, 16)
+        if _, err := secureW.Write(make([]byte, 17)); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+        if _, err := secureW.Write(make([]byte, 16)); err != nil {
+                t.Fatal(err)
+        }
+
+        // A reader with a smaller limit refuses the frame.
+        secureR := NewSecureReaderSize(&buf, priv, pub, 8)
+        if _, err := secureR.Read(make([]byte, 1024)); err != ErrFrameTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrFrameTooLarge)
+        }
+}
+
+// headerOnlyReader serves a frame header and fails the test if read
+// further.
+type headerOnlyReader struct {
+        t   *testing.T
+        hdr []byte
+}
+
+func (r *headerOnlyReader) Read(p []byte) (int, error) {
+        if len(r.hdr) == 0 {
+                r.t.Fatal("Unexpected read past the frame header")
+        }
+        n := copy(p, r.hdr)
+        r.hdr = r.hdr[n:]
+        return n, nil
+}
+
+func TestMoreBogusFrameLength(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        hdr := make([]byte, HeaderLen+NonceLen)
+        hdr[0] = frameVersion
+        hdr[2], hdr[3], hdr[4] = 0xff, 0xff, 0xff
+        secureR := NewSecureReader(&headerOnlyReader{t, hdr}, priv, pub)
+        if _, err := secureR.Read(make([]byte, 1024)); err != ErrFrameTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrFrameTooLarge)
+        }
+}
+
+func TestMoreFrameVersion(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        fmt.Fprint(NewSecureWriter(&buf, priv, pub), "hello world\n")
+        if buf.Bytes()[0] != frameVersion {
+                t.Fatalf("Unexpected frame version: got %d, expected %d", buf.Bytes()[0], frameVersion)
+        }
+
+        // Unknown versions are rejected before reading the rest.
+        hdr := append([]byte(nil), buf.Bytes()[:HeaderLen+NonceLen]...)
+        hdr[0] = frameVersion + 1
+        secureR := NewSecureReader(&headerOnlyReader{t, hdr}, priv, pub)
+        if _, err := secureR.Read(make([]byte, 1024)); err != ErrUnsupportedFrameVersion {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrUnsupportedFrameVersion)
+        }
+
+        // The version is authenticated: a frame sealed under another one
+        // doesn't open.
+        var nonce [NonceLen]byte
+        frame := make([]byte, HeaderLen, HeaderLen+NonceLen)
+        putHeader(frame, 0, len("hello world\n")+BoxOverhead)
+        frame = append(frame, nonce[:]...)
+        sealed := sealNonce(nonce, frameVersion+1, 0)
+        frame = box.Seal(frame, []byte("hello world\n"), &sealed, pub, priv)
+        secureR = NewSecureReader(bytes.NewReader(frame), priv, pub)
+        if _, err := secureR.Read(make([]byte, 1024)); !errors.Is(err, ErrDecryptionError) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrDecryptionError)
+        }
+}
+
+func TestMoreDialPinned(t *testing.T) {
+        pub, _, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        // Answer every handshake with pub.
+        go func() {
+                for {
+                        conn, err := l.Accept()
+                        if err != nil {
+                                return
+                        }
+                        go func(c net.Conn) {
+                                defer c.Close()
+                                serverHandshake(c, pub, nil)
+                                io.Copy(ioutil.Discard, c)
+                        }(conn)
+                }
+        }()
+
+        conn, err := DialPinned(l.Addr().String(), pub)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := conn.PeerPublicKey(); *got != *pub {
+                t.Fatalf("Unexpected peer key: %x != %x", *got, *pub)
+        }
+        conn.Close()
+
+        other := &[32]byte{'o', 't', 'h', 'e', 'r'}
+        if _, err := DialPinned(l.Addr().String(), other); err != ErrKeyMismatch {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrKeyMismatch)
+        }
+}
+
+func TestMoreReplay(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        fmt.Fprint(secureW, "hello world\n")
+
+        // Send the same frame twice.
+        frame := append([]byte(nil), buf.Bytes()...)
+        buf.Write(frame)
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        if _, err := secureR.Read(make([]byte, 1024)); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := secureR.Read(make([]byte, 1024)); err != ErrReplay {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrReplay)
+        }
+}
+
+func TestMoreSmallReads(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        expected := "the quick brown fox jumps over the lazy dog\n"
+        fmt.Fprint(secureW, expected)
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        var got []byte
+        chunk := make([]byte, 7)
+        for {
+                n, err := secureR.Read(chunk)
+                if err == io.EOF {
+                        break
+                }
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if n > len(chunk) {
+                        t.Fatalf("Read returned %d bytes for a %d bytes buffer", n, len(chunk))
+                }
+                got = append(got, chunk[:n]...)
+        }
+        if string(got) != expected {
+                t.Fatalf("Unexpected result: %q != %q", got, expected)
+        }
+}
+
+func TestMoreCopy(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        expected := bytes.Repeat([]byte("hello world\n"), 10000)
+
+        // Encrypt through ReadFrom.
+        var wire bytes.Buffer
+        secureW := NewSecureWriter(&wire, priv, pub)
+        if n, err := secureW.ReadFrom(bytes.NewReader(expected)); err != nil || n != int64(len(expected)) {
+                t.Fatalf("Unexpected result: %d, %v", n, err)
+        }
+
+        // Decrypt through WriteTo.
+        var got bytes.Buffer
+        secureR := NewSecureReader(&wire, priv, pub)
+        if n, err := io.Copy(&got, secureR); err != nil || n != int64(len(expected)) {
+                t.Fatalf("Unexpected result: %d, %v", n, err)
+        }
+        if !bytes.Equal(got.Bytes(), expected) {
+                t.Fatal("Unexpected result. The copied data doesn't match.")
+        }
+}
+
+// benchmarkCopy decrypts and re-encrypts 1MB of frames per iteration.
+func benchmarkCopy(b *testing.B, copy func(dst io.Writer, src io.Reader) (int64, error)) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        msg := make([]byte, 1024)
+        var wire bytes.Buffer
+        secureW := NewSecureWriter(&wire, priv, pub)
+        for i := 0; i < 1024; i++ {
+                secureW.Write(msg)
+        }
+        frames := wire.Bytes()
+
+        b.SetBytes(int64(len(msg) * 1024))
+        b.ReportAllocs()
+        b.ResetTimer()
+        for i := 0; i < b.N; i++ {
+                secureR := NewSecureReader(bytes.NewReader(frames), priv, pub)
+                secureW := NewSecureWriter(ioutil.Discard, priv, pub)
+                if _, err := copy(secureW, secureR); err != nil {
+                        b.Fatal(err)
+                }
+        }
+}
+
+func BenchmarkMoreCopy(b *testing.B) {
+        benchmarkCopy(b, io.Copy)
+}
+
+func BenchmarkMoreCopyGeneric(b *testing.B) {
+        // Hide WriterTo and ReaderFrom to force the generic io.Copy path.
+        benchmarkCopy(b, func(dst io.Writer, src io.Reader) (int64, error) {
+                return io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+        })
+}
+
+func BenchmarkMoreWrite1K(b *testing.B) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        msg := make([]byte, 1024)
+        secureW := NewSecureWriter(ioutil.Discard, priv, pub)
+        b.SetBytes(int64(len(msg)))
+        b.ReportAllocs()
+        b.ResetTimer()
+        for i := 0; i < b.N; i++ {
+                if _, err := secureW.Write(msg); err != nil {
+                        b.Fatal(err)
+                }
+        }
+}
+
+func BenchmarkMoreRead1K(b *testing.B) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        msg := make([]byte, 1024)
+        var wire bytes.Buffer
+        secureW := NewSecureWriter(&wire, priv, pub)
+        for i := 0; i < b.N; i++ {
+                secureW.Write(msg)
+        }
+        secureR := NewSecureReader(&wire, priv, pub)
+
+        b.SetBytes(int64(len(msg)))
+        b.ReportAllocs()
+        b.ResetTimer()
+        for i := 0; i < b.N; i++ {
+                if _, err := secureR.Read(msg); err != nil {
+                        b.Fatal(err)
+                }
+        }
+}
+
+func BenchmarkMoreEcho(b *testing.B) {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                b.Fatal(err)
+        }
+        s := &Server{}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        conn, err := Dial(l.Addr().String())
+        if err != nil {
+                b.Fatal(err)
+        }
+        defer conn.Close()
+
+        msg := make([]byte, MaxMsgLen)
+        buf := make([]byte, MaxMsgLen)
+        b.SetBytes(int64(len(msg)))
+        b.ReportAllocs()
+        b.ResetTimer()
+        for i := 0; i < b.N; i++ {
+                if _, err := conn.Write(msg); err != nil {
+                        b.Fatal(err)
+                }
+                if _, err := io.ReadFull(conn, buf); err != nil {
+                        b.Fatal(err)
+                }
+        }
+}
+
+func TestMoreServerShutdown(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        var s Server
+        served := make(chan error, 1)
+        go func() { served <- s.Serve(l) }()
+
+        conn, err := Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        expected := "hello world\n"
+        if _, err := fmt.Fprint(conn, expected); err != nil {
+                t.Fatal(err)
+        }
+        buf := make([]byte, 1024)
+        n, err := conn.Read(buf)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := string(buf[:n]); got != expected {
+                t.Fatalf("Unexpected result: %s != %s", got, expected)
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        if err := s.Shutdown(ctx); err != nil {
+                t.Fatal(err)
+        }
+        if err := <-served; err != ErrServerClosed {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrServerClosed)
+        }
+
+        // The server closed our connection.
+        if _, err := conn.Read(buf); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMoreConcurrentWrites(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+
+        const writers = 50
+        var wg sync.WaitGroup
+        for i := 0; i < writers; i++ {
+                wg.Add(1)
+                go func(i int) {
+                        defer wg.Done()
+                        msg := strings.Repeat(fmt.Sprintf("message %02d;", i), 100)
+                        if _, err := secureW.Write([]byte(msg)); err != nil {
+                                t.Error(err)
+                        }
+                }(i)
+        }
+        wg.Wait()
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        seen := make(map[string]bool)
+        got := make([]byte, MaxMsgLen)
+        for i := 0; i < writers; i++ {
+                n, err := secureR.Read(got)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                msg := string(got[:n])
+                if msg != strings.Repeat(msg[:len("message 00;")], 100) {
+                        t.Fatalf("Corrupted message: %q", msg)
+                }
+                seen[msg] = true
+        }
+        if len(seen) != writers {
+                t.Fatalf("Got %d distinct messages, expected %d", len(seen), writers)
+        }
+}
+
+func TestMoreVersionNegotiation(t *testing.T) {
+        serverPub, clientPub := &[32]byte{'s'}, &[32]byte{'c'}
+
+        tData := []struct {
+                offered  [][]byte
+                expected []byte
+        }{
+                {[][]byte{protocolHandshake}, protocolHandshake},
+                {[][]byte{[]byte("whispering gophers 9"), protocolHandshake}, protocolHandshake},
+                {[][]byte{[]byte("whispering gophers 9")}, nil},
+        }
+
+        for _, exp := range tData {
+                client, server := net.Pipe()
+                errc := make(chan error, 1)
+                go func() {
+                        defer server.Close()
+                        _, _, err := serverHandshake(server, serverPub, nil)
+                        errc <- err
+                }()
+
+                key, version, err := clientHandshake(client, clientPub, exp.offered, nil)
+                client.Close()
+                serverErr := <-errc
+                if exp.expected == nil {
+                        if err == nil || !errors.Is(serverErr, ErrBadHandshake) {
+                                t.Fatalf("%q: expected the handshake to fail, got %v and %v", exp.offered, err, serverErr)
+                        }
+                        continue
+                }
+                if err != nil {
+                        t.Fatalf("%q: %v", exp.offered, err)
+                }
+                if serverErr != nil {
+                        t.Fatalf("%q: %v", exp.offered, serverErr)
+                }
+                if *key != *serverPub {
+                        t.Fatalf("%q: unexpected server key %x", exp.offered, *key)
+                }
+                if !bytes.Equal(version, exp.expected) {
+                        t.Fatalf("%q: negotiated %q, expected %q", exp.offered, version, exp.expected)
+                }
+        }
+}
+
+func TestMoreWeakKey(t *testing.T) {
+        zero := &[32]byte{}
+
+        // The server rejects a zero client key.
+        client, server := net.Pipe()
+        go func() {
+                defer client.Close()
+                clientHandshake(client, zero, protocolVersions, nil)
+        }()
+        if _, _, err := serverHandshake(server, &[32]byte{'s'}, nil); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+        server.Close()
+
+        // The client rejects a zero server key.
+        client, server = net.Pipe()
+        go func() {
+                defer server.Close()
+                serverHandshake(server, zero, nil)
+        }()
+        if _, _, err := clientHandshake(client, &[32]byte{'c'}, protocolVersions, nil); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+        client.Close()
+}
+
+func TestMorePaddedMessages(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriterPadded(&buf, priv, pub, 256)
+        secureR := NewSecureReader(&buf, priv, pub)
+
+        got := make([]byte, MaxMsgLen)
+        for _, size := range []int{1, 100, 250, 251, 1000, MaxMsgLen} {
+                msg := bytes.Repeat([]byte{'p'}, size)
+                if _, err := secureW.Write(msg); err != nil {
+                        t.Fatal(err)
+                }
+                if size < 250 && buf.Len() != 256+MsgOverhead {
+                        t.Fatalf("%d bytes message: got a %d bytes frame, expected %d", size, buf.Len(), 256+MsgOverhead)
+                }
+                n, err := secureR.Read(got)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if !bytes.Equal(got[:n], msg) {
+                        t.Fatalf("Unexpected result: got %d bytes, expected %d", n, size)
+                }
+        }
+
+        // Clearing the padding flag is detected.
+        fmt.Fprint(secureW, "hello world\n")
+        buf.Bytes()[1] = 0
+        if _, err := secureR.Read(got); !errors.Is(err, ErrDecryptionError) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrDecryptionError)
+        }
+}
+
+func TestMoreRekeying(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriterRekeying(&buf, priv, pub, 100)
+        secureR := NewSecureReader(&buf, priv, pub)
+
+        got := make([]byte, 1024)
+        for i := 0; i < 10; i++ {
+                expected := strings.Repeat(fmt.Sprint(i), 60)
+                if _, err := fmt.Fprint(secureW, expected); err != nil {
+                        t.Fatal(err)
+                }
+                n, err := secureR.Read(got)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if string(got[:n]) != expected {
+                        t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+                }
+        }
+
+        // The reader no longer accepts frames sealed with the original key.
+        fmt.Fprint(NewSecureWriter(&buf, priv, pub), "hello world\n")
+        if _, err := secureR.Read(got); !errors.Is(err, ErrDecryptionError) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrDecryptionError)
+        }
+}
+
+func TestMoreServeFunc(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        go ServeFunc(l, func(rw io.ReadWriteCloser) {
+                buf := make([]byte, MaxMsgLen)
+                n, err := rw.Read(buf)
+                if err != nil {
+                        return
+                }
+                rw.Write(bytes.ToUpper(buf[:n]))
+        })
+
+        conn, err := Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        if _, err := fmt.Fprint(conn, "hello world\n"); err != nil {
+                t.Fatal(err)
+        }
+        buf := make([]byte, 1024)
+        n, err := conn.Read(buf)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := string(buf[:n]); got != "HELLO WORLD\n" {
+                t.Fatalf("Unexpected result: %s", got)
+        }
+
+        // The connection is closed once the handler returns.
+        if _, err := conn.Read(buf); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMoreServeLimit(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        const maxConns = 3
+        var (
+                mu              sync.Mutex
+                active, maxSeen int
+        )
+        started := make(chan struct{}, maxConns+5)
+        release := make(chan struct{})
+        s := &Server{
+                MaxConns: maxConns,
+                Handler: func(rw io.ReadWriteCloser) {
+                        mu.Lock()
+                        active++
+                        if active > maxSeen {
+                                maxSeen = active
+                        }
+                        mu.Unlock()
+                        started <- struct{}{}
+
+                        <-release
+                        mu.Lock()
+                        active--
+                        mu.Unlock()
+                },
+        }
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        var wg sync.WaitGroup
+        for i := 0; i < maxConns+5; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        if conn, err := Dial(l.Addr().String()); err == nil {
+                                conn.Close()
+                        }
+                }()
+        }
+
+        for i := 0; i < maxConns; i++ {
+                <-started
+        }
+        select {
+        case <-started:
+                t.Fatal("More than maxConns connections are served at once")
+        case <-time.After(100 * time.Millisecond):
+        }
+
+        close(release)
+        for i := maxConns; i < maxConns+5; i++ {
+                <-started
+        }
+        wg.Wait()
+
+        mu.Lock()
+        defer mu.Unlock()
+        if maxSeen != maxConns {
+                t.Fatalf("Served %d connections at once, expected %d", maxSeen, maxConns)
+        }
+}
+
+func TestMoreServerHandshakeTimeout(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        s := &Server{HandshakeTimeout: 50 * time.Millisecond}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        conn, err := net.Dial("tcp", l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        // Send nothing and wait for the server to give up.
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMoreDialHandshakeTimeout(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        // Accept connections but never answer the handshake.
+        go func() {
+                for {
+                        conn, err := l.Accept()
+                        if err != nil {
+                                return
+                        }
+                        defer conn.Close()
+                }
+        }()
+
+        _, err = DialTimeout(l.Addr().String(), 50*time.Millisecond)
+        if !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+        var ne net.Error
+        if !errors.As(err, &ne) || !ne.Timeout() {
+                t.Fatalf("Unexpected error: %v is not a timeout", err)
+        }
+}
+
+func TestMoreKeySerialization(t *testing.T) {
+        pub, priv, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        k, err := DecodeKey(EncodeKey(pub))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if *k != *pub {
+                t.Fatalf("Unexpected key: got %x, expected %x", *k, *pub)
+        }
+
+        var buf bytes.Buffer
+        if err := WriteKeyPEM(&buf, priv); err != nil {
+                t.Fatal(err)
+        }
+        k, err = ReadKeyPEM(&buf)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if *k != *priv {
+                t.Fatalf("Unexpected key: got %x, expected %x", *k, *priv)
+        }
+
+        for _, s := range []string{"", "zz", EncodeKey(pub)[2:], EncodeKey(pub) + "00"} {
+                if _, err := DecodeKey(s); err != ErrInvalidKey {
+                        t.Errorf("DecodeKey(%q): got %v, expected %v", s, err, ErrInvalidKey)
+                }
+        }
+        if _, err := ReadKeyPEM(strings.NewReader("not a key")); err != ErrInvalidKey {
+                t.Errorf("Unexpected error: got %v, expected %v", err, ErrInvalidKey)
+        }
+}
+
+func TestMoreFingerprint(t *testing.T) {
+        tests := []struct {
+                key [32]byte
+                fp  string
+        }{
+                {[32]byte{}, "66:68:7a:ad:f8:62:bd:77:6c:8f:c1:8b:8e:9f:8e:20"},
+                {[32]byte{'k', 'e', 'y'}, "7a:b8:ce:c0:4a:4c:aa:80:98:1c:64:08:54:88:00:d7"},
+        }
+        for _, tt := range tests {
+                if fp := Fingerprint(&tt.key); fp != tt.fp {
+                        t.Errorf("Fingerprint(%x): got %q, expected %q", tt.key, fp, tt.fp)
+                }
+        }
+}
+
+func TestMoreNetConn(t *testing.T) {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        s := &Server{Handler: func(rwc io.ReadWriteCloser) {
+                io.Copy(ioutil.Discard, rwc)
+        }}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        var conn net.Conn
+        conn, err = Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        if conn.RemoteAddr().String() != l.Addr().String() {
+                t.Fatalf("Unexpected remote address: got %v, expected %v", conn.RemoteAddr(), l.Addr())
+        }
+        if conn.LocalAddr() == nil {
+                t.Fatal("Unexpected nil local address")
+        }
+
+        conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+        _, err = conn.Read(make([]byte, 1))
+        var ne net.Error
+        if !errors.As(err, &ne) || !ne.Timeout() {
+                t.Fatalf("Unexpected error: got %v, expected a timeout", err)
+        }
+}
+
+func TestMorePipe(t *testing.T) {
+        client, server, err := Pipe()
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer client.Close()
+        defer server.Close()
+
+        if *client.PeerPublicKey() == *server.PeerPublicKey() {
+                t.Fatal("Unexpected result. Both ends have the same key.")
+        }
+        if client.PeerIdentity() != nil || server.PeerIdentity() != nil {
+                t.Fatal("Unexpected identity on an unauthenticated connection")
+        }
+        if *client.PublicKey() != *server.PeerPublicKey() {
+                t.Fatalf("Unexpected public key: %x != %x", *client.PublicKey(), *server.PeerPublicKey())
+        }
+        priv, peerPub := client.Keys()
+        if *peerPub != *client.PeerPublicKey() {
+                t.Fatalf("Unexpected peer key: %x != %x", *peerPub, *client.PeerPublicKey())
+        }
+        var pub [32]byte
+        curve25519.ScalarBaseMult(&pub, priv)
+        if pub != *client.PublicKey() {
+                t.Fatalf("Unexpected private key: public half %x != %x", pub, *client.PublicKey())
+        }
+        done := make(chan struct{})
+        go func() {
+                EchoHandler(server)
+                close(done)
+        }()
+
+        expected := "hello world\n"
+        if _, err := fmt.Fprint(client, expected); err != nil {
+                t.Fatal(err)
+        }
+        got := make([]byte, 1024)
+        n, err := client.Read(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+
+        l := int64(len(expected))
+        if r, w := client.BytesRead(), client.BytesWritten(); r != l || w != l {
+                t.Fatalf("Unexpected byte counts: read %d and wrote %d, expected %d", r, w, l)
+        }
+        client.Close()
+        <-done
+        if r, w := server.BytesRead(), server.BytesWritten(); r != l || w != l {
+                t.Fatalf("Unexpected server byte counts: read %d and wrote %d, expected %d", r, w, l)
+        }
+}
+
+func TestMoreWrapConn(t *testing.T) {
+        client, server := net.Pipe()
+        defer client.Close()
+        defer server.Close()
+
+        go func() {
+                conn, err := WrapServer(server)
+                if err != nil {
+                        return
+                }
+                EchoHandler(conn)
+        }()
+
+        conn, err := WrapClient(client)
+        if err != nil {
+                t.Fatal(err)
+        }
+        expected := "hello world\n"
+        if _, err := fmt.Fprint(conn, expected); err != nil {
+                t.Fatal(err)
+        }
+        got := make([]byte, 1024)
+        n, err := conn.Read(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+}
+
+func TestMoreMultipleMessages(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        expected := []string{"first message", "second", "and the third one"}
+        for _, msg := range expected {
+                if _, err := fmt.Fprint(secureW, msg); err != nil {
+                        t.Fatal(err)
+                }
+        }
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        got := make([]byte, 1024)
+        for _, msg := range expected {
+                n, err := secureR.Read(got)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if string(got[:n]) != msg {
+                        t.Fatalf("Unexpected result: %s != %s", got[:n], msg)
+                }
+        }
+        if _, err := secureR.Read(got); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMorePing(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        if err := secureW.WritePing(); err != nil {
+                t.Fatal(err)
+        }
+        if buf.Len() != MsgOverhead {
+                t.Fatalf("Unexpected ping size: got %d, expected %d", buf.Len(), MsgOverhead)
+        }
+        expected := "hello world\n"
+        fmt.Fprint(secureW, expected)
+        secureW.WritePing()
+
+        pings := 0
+        secureR := NewSecureReader(&buf, priv, pub)
+        secureR.SetPingHandler(func() { pings++ })
+        got := make([]byte, 1024)
+        n, err := secureR.Read(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+        if _, err := secureR.Read(got); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+        if pings != 2 {
+                t.Fatalf("Unexpected number of pings: got %d, expected 2", pings)
+        }
+}
+
+func TestMoreSecurePacketConn(t *testing.T) {
+        pubA, privA, _ := box.GenerateKey(rand.Reader)
+        pubB, privB, _ := box.GenerateKey(rand.Reader)
+
+        rawA, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer rawA.Close()
+        rawB, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer rawB.Close()
+        a := NewSecurePacketConn(rawA, privA, pubB)
+        b := NewSecurePacketConn(rawB, privB, pubA)
+
+        // A forged datagram is dropped, the authentic one goes through.
+        if _, err := rawA.WriteTo([]byte("forged datagram which is long enough"), rawB.LocalAddr()); err != nil {
+                t.Fatal(err)
+        }
+        expected := "hello world\n"
+        if _, err := a.WriteTo([]byte(expected), rawB.LocalAddr()); err != nil {
+                t.Fatal(err)
+        }
+
+        b.SetReadDeadline(time.Now().Add(5 * time.Second))
+        got := make([]byte, 1024)
+        n, addr, err := b.ReadFrom(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+        if addr.String() != rawA.LocalAddr().String() {
+                t.Fatalf("Unexpected sender: got %v, expected %v", addr, rawA.LocalAddr())
+        }
+
+        // The largest message fits in a datagram, a longer one is refused
+        // without sending anything.
+        // The largest message fills the largest UDP payload, which some
+        // systems can't send over loopback, so the datagrams are recorded.
+        rec := new(packetRecorder)
+        c := NewSecurePacketConn(rec, privA, pubB)
+        long := make([]byte, maxPacketMsgLen+1)
+        if _, err := c.WriteTo(long, rawB.LocalAddr()); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+        if _, err := c.WriteTo(long[:maxPacketMsgLen], rawB.LocalAddr()); err != nil {
+                t.Fatal(err)
+        }
+        if len(rec.packets) != 1 || len(rec.packets[0]) != maxPacketLen {
+                t.Fatalf("Unexpected datagrams: got %d, expected one of %d bytes", len(rec.packets), maxPacketLen)
+        }
+        var nonce [NonceLen]byte
+        copy(nonce[:], rec.packets[0])
+        if msg, ok := box.Open(nil, rec.packets[0][NonceLen:], &nonce, pubA, privB); !ok || len(msg) != maxPacketMsgLen {
+                t.Fatalf("Unexpected datagram: opened %v, %d bytes", ok, len(msg))
+        }
+}
+
+// packetRecorder keeps the datagrams written instead of sending them.
+type packetRecorder struct {
+        net.PacketConn
+        packets [][]byte
+}
+
+func (r *packetRecorder) WriteTo(p []byte, addr net.Addr) (int, error) {
+        r.packets = append(r.packets, append([]byte(nil), p...))
+        return len(p), nil
+}
+
+func TestMoreFrameConstants(t *testing.T) {
+        if MsgOverhead != HeaderLen+NonceLen+BoxOverhead {
+                t.Fatalf("Unexpected overhead: %d != %d + %d + %d", MsgOverhead, HeaderLen, NonceLen, BoxOverhead)
+        }
+
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        if _, err := secureW.Write(make([]byte, MaxMsgLen)); err != nil {
+                t.Fatal(err)
+        }
+        if buf.Len() != MaxMsgLen+MsgOverhead {
+                t.Fatalf("Unexpected frame size: got %d, expected %d", buf.Len(), MaxMsgLen+MsgOverhead)
+        }
+}
+
+func TestMoreReadDeadline(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var frame bytes.Buffer
+        fmt.Fprint(NewSecureWriter(&frame, priv, pub), "hello world\n")
+
+        client, server := net.Pipe()
+        defer client.Close()
+        defer server.Close()
+        secureR := NewSecureReader(client, priv, pub)
+
+        // Idle, then in the middle of a frame.
+        for _, sent := range []int{0, HeaderLen + NonceLen + 2} {
+                go server.Write(frame.Bytes()[:sent])
+                client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+                _, err := secureR.Read(make([]byte, 1024))
+                var ne net.Error
+                if !errors.As(err, &ne) || !ne.Timeout() {
+                        t.Fatalf("%d bytes sent: got %v, expected a timeout", sent, err)
+                }
+        }
+}
+
+func TestMoreCompressedMessages(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        random := make([]byte, 1024)
+        rand.Read(random)
+        tData := []struct {
+                msg  []byte
+                size int // frame size upper bound
+        }{
+                {[]byte("hi"), 2 + MsgOverhead},
+                {bytes.Repeat([]byte("hello world\n"), 1000), 200 + MsgOverhead},
+                {random, len(random) + MsgOverhead},
+                {make([]byte, MaxMsgLen), 200 + MsgOverhead},
+        }
+
+        for _, exp := range tData {
+                var buf bytes.Buffer
+                secureW := NewSecureWriterCompressed(&buf, priv, pub)
+                if _, err := secureW.Write(exp.msg); err != nil {
+                        t.Fatal(err)
+                }
+                if buf.Len() > exp.size {
+                        t.Fatalf("Unexpected frame size: got %d, expected at most %d", buf.Len(), exp.size)
+                }
+
+                got, err := ioutil.ReadAll(NewSecureReader(&buf, priv, pub))
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if !bytes.Equal(got, exp.msg) {
+                        t.Fatalf("Unexpected result: got %d bytes, expected %d", len(got), len(exp.msg))
+                }
+        }
+
+        var buf bytes.Buffer
+        if _, err := NewSecureWriterCompressed(&buf, priv, pub).Write(make([]byte, MaxMsgLen+1)); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+
+        // A reader with a smaller limit rejects what inflates past it.
+        NewSecureWriterCompressed(&buf, priv, pub).Write(make([]byte, 2048))
+        if _, err := NewSecureReaderSize(&buf, priv, pub, 1024).Read(make([]byte, 2048)); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+}
+
+func TestMoreAAD(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        if _, err := secureW.WriteWithAAD([]byte("hello world\n"), []byte("channel 1")); err != nil {
+                t.Fatal(err)
+        }
+        fmt.Fprint(secureW, "no aad")
+        frames := append([]byte(nil), buf.Bytes()...)
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        got := make([]byte, 1024)
+        n, aad, err := secureR.ReadWithAAD(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != "hello world\n" || string(aad) != "channel 1" {
+                t.Fatalf("Unexpected result: %q with %q", got[:n], aad)
+        }
+        n, aad, err = secureR.ReadWithAAD(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != "no aad" || aad != nil {
+                t.Fatalf("Unexpected result: %q with %q", got[:n], aad)
+        }
+
+        // Tamper with the additional data, then with the flags.
+        for _, i := range []int{HeaderLen + NonceLen + BoxOverhead + aadHeaderLen, 1} {
+                tampered := append([]byte(nil), frames...)
+                tampered[i] ^= flagAAD
+                if _, _, err := NewSecureReader(bytes.NewReader(tampered), priv, pub).ReadWithAAD(got); !errors.Is(err, ErrDecryptionError) {
+                        t.Fatalf("Byte %d: got %v, expected %v", i, err, ErrDecryptionError)
+                }
+        }
+
+        if _, err := secureW.WriteWithAAD(make([]byte, MaxMsgLen), []byte("aad")); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+}
+
+func TestMoreDialAuth(t *testing.T) {
+        serverID, serverIDPriv, err := GenerateIdentity(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+        clientID, clientIDPriv, err := GenerateIdentity(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+        strangerID, strangerIDPriv, err := GenerateIdentity(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        peers := make(chan *[32]byte, 1)
+        s := &Server{
+                Identity: serverIDPriv,
+                AuthorizePeer: func(id *[32]byte) bool {
+                        return *id != *strangerID
+                },
+                Handler: func(rwc io.ReadWriteCloser) {
+                        peers <- rwc.(Conn).PeerIdentity()
+                        EchoHandler(rwc)
+                },
+        }
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        conn, err := DialAuth(l.Addr().String(), clientIDPriv, serverID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        if got := conn.PeerIdentity(); got == nil || *got != *serverID {
+                t.Fatalf("Unexpected server identity: got %v, expected %x", got, *serverID)
+        }
+        if got := <-peers; got == nil || *got != *clientID {
+                t.Fatalf("Unexpected client identity: got %v, expected %x", got, *clientID)
+        }
+        expected := "hello world\n"
+        fmt.Fprint(conn, expected)
+        got := make([]byte, 1024)
+        n, err := conn.Read(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+
+        // Any server identity is accepted without an expected one.
+        conn, err = DialAuth(l.Addr().String(), clientIDPriv, nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        if got := conn.PeerIdentity(); got == nil || *got != *serverID {
+                t.Fatalf("Unexpected server identity: got %v, expected %x", got, *serverID)
+        }
+        <-peers
+
+        // The server isn't the one expected.
+        if _, err := DialAuth(l.Addr().String(), clientIDPriv, clientID); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+        // The client isn't authorized.
+        if _, err := DialAuth(l.Addr().String(), strangerIDPriv, serverID); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+}
+
+func TestMoreReset(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+        priv2, pub2 := &[32]byte{'p', 'r', 'i', 'v', '2'}, &[32]byte{'p', 'u', 'b', '2'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        fmt.Fprint(secureW, "stale leftover")
+        secureR := NewSecureReader(&buf, priv, pub)
+        if _, err := secureR.Read(make([]byte, 5)); err != nil {
+                t.Fatal(err)
+        }
+
+        var buf2 bytes.Buffer
+        secureW.Reset(&buf2, priv2, pub2)
+        fmt.Fprint(secureW, "hello world\n")
+        if buf.Len() != 0 {
+                t.Fatal("Unexpected write to the previous writer")
+        }
+        secureR.Reset(&buf2, priv2, pub2)
+        got, err := ioutil.ReadAll(secureR)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got) != "hello world\n" {
+                t.Fatalf("Unexpected result: %q != %q", got, "hello world\n")
+        }
+}
+
+func TestMoreDebugLogger(t *testing.T) {
+        var mu sync.Mutex
+        seen := make(map[EventKind]int)
+        DebugLogger = LoggerFunc(func(e Event) {
+                mu.Lock()
+                defer mu.Unlock()
+                seen[e.Kind]++
+                if (e.Kind == EventFrameWritten || e.Kind == EventFrameRead) && e.Size != len("hello")+MsgOverhead {
+                        t.Errorf("Unexpected %v size: got %d, expected %d", e.Kind, e.Size, len("hello")+MsgOverhead)
+                }
+        })
+        defer func() { DebugLogger = nil }()
+
+        client, server, err := Pipe()
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer client.Close()
+        defer server.Close()
+        written := make(chan struct{})
+        go func() {
+                fmt.Fprint(client, "hello")
+                close(written)
+        }()
+        if _, err := server.Read(make([]byte, 1024)); err != nil {
+                t.Fatal(err)
+        }
+        <-written
+
+        mu.Lock()
+        defer mu.Unlock()
+        expected := map[EventKind]int{
+                EventHandshakeStart: 2,
+                EventKeyReceived:    2,
+                EventFrameWritten:   1,
+                EventFrameRead:      1,
+        }
+        for kind, n := range expected {
+                if seen[kind] != n {
+                        t.Errorf("Unexpected number of %q events: got %d, expected %d", kind, seen[kind], n)
+                }
+        }
+}
+
+func TestMoreServerIdleTimeout(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        s := &Server{IdleTimeout: 50 * time.Millisecond}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        conn, err := Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        expected := "hello world\n"
+        fmt.Fprint(conn, expected)
+        got := make([]byte, 1024)
+        n, err := conn.Read(got)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got[:n]) != expected {
+                t.Fatalf("Unexpected result: %s != %s", got[:n], expected)
+        }
+
+        // Go idle and wait for the server to give up.
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        if _, err := conn.Read(got); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMoreServerMaxConnBytes(t *testing.T) {
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        s := &Server{MaxConnBytes: 10}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        conn, err := Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+        // Only the first 10 bytes are echoed, then the server hangs up.
+        fmt.Fprint(conn, "hello ")
+        fmt.Fprint(conn, "world\n")
+        got, err := ioutil.ReadAll(conn)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got) != "hello worl" {
+                t.Fatalf("Unexpected result: %q != %q", got, "hello worl")
+        }
+}
+
+func TestMoreDialWithKey(t *testing.T) {
+        pub, priv, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        peers := make(chan *[32]byte, 2)
+        s := &Server{Handler: func(rwc io.ReadWriteCloser) {
+                peers <- rwc.(Conn).PeerPublicKey()
+        }}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        for i := 0; i < 2; i++ {
+                conn, err := DialWithKey(l.Addr().String(), priv, pub)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                conn.Close()
+                if got := <-peers; *got != *pub {
+                        t.Fatalf("Unexpected client key: %x != %x", *got, *pub)
+                }
+        }
+
+        other := &[32]byte{'o', 't', 'h', 'e', 'r'}
+        if _, err := DialWithKey(l.Addr().String(), priv, other); err != ErrInvalidKey {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrInvalidKey)
+        }
+}
+
+func TestMoreNextMessage(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var buf bytes.Buffer
+        secureW := NewSecureWriter(&buf, priv, pub)
+        expected := []string{"first", "second message", "3"}
+        for _, msg := range expected {
+                fmt.Fprint(secureW, msg)
+        }
+
+        secureR := NewSecureReader(&buf, priv, pub)
+        for _, exp := range expected {
+                msg, err := secureR.NextMessage()
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if string(msg) != exp || cap(msg) != len(exp) {
+                        t.Fatalf("Unexpected message: got %q (cap %d), expected %q", msg, cap(msg), exp)
+                }
+        }
+        if _, err := secureR.NextMessage(); err != io.EOF {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.EOF)
+        }
+}
+
+func TestMoreCloseWrite(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        // The pipe stays open: only the end of stream frame ends the reads.
+        r, w := io.Pipe()
+        defer w.Close()
+        secureW := NewSecureWriter(w, priv, pub)
+        go func() {
+                fmt.Fprint(secureW, "hello world\n")
+                secureW.CloseWrite()
+        }()
+
+        got, err := ioutil.ReadAll(NewSecureReader(r, priv, pub))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got) != "hello world\n" {
+                t.Fatalf("Unexpected result: %q != %q", got, "hello world\n")
+        }
+        if _, err := secureW.Write([]byte("late")); err != io.ErrClosedPipe {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.ErrClosedPipe)
+        }
+}
+
+func TestMoreStrictReader(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var wire bytes.Buffer
+        secureW := NewSecureWriter(&wire, priv, pub)
+        fmt.Fprint(secureW, "hello world\n")
+        first := wire.Len()
+        secureW.CloseWrite()
+        frames := wire.Bytes()
+
+        for _, tt := range []struct {
+                strict   bool
+                trailing string
+                err      error
+        }{
+                {false, "", nil},
+                {true, "", nil},
+                {false, "injected", nil},
+                {true, "injected", ErrTrailingData},
+        } {
+                secureR := NewSecureReader(io.MultiReader(bytes.NewReader(frames), strings.NewReader(tt.trailing)), priv, pub)
+                secureR.SetStrict(tt.strict)
+                got, err := ioutil.ReadAll(secureR)
+                if err != tt.err {
+                        t.Fatalf("strict %v, trailing %q: got %v, expected %v", tt.strict, tt.trailing, err, tt.err)
+                }
+                if string(got) != "hello world\n" {
+                        t.Fatalf("Unexpected result: %q != %q", got, "hello world\n")
+                }
+        }
+
+        // Data injected between frames is taken for a frame and rejected.
+        var injected []byte
+        injected = append(injected, frames[:first]...)
+        injected = append(injected, "injected"...)
+        injected = append(injected, frames[first:]...)
+        secureR := NewSecureReader(bytes.NewReader(injected), priv, pub)
+        if _, err := ioutil.ReadAll(secureR); err == nil {
+                t.Fatal("Injected data went unnoticed")
+        }
+}
+
+func TestMoreCounterNonces(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var wire bytes.Buffer
+        secureW := NewSecureWriterCounter(&wire, priv, pub, 41)
+        var lens []int
+        for _, msg := range []string{"hello", "world"} {
+                if _, err := secureW.Write([]byte(msg)); err != nil {
+                        t.Fatal(err)
+                }
+                lens = append(lens, wire.Len())
+        }
+        secureW.WritePing()
+
+        frames := wire.Bytes()
+        for i, start := range []int{0, lens[0], lens[1]} {
+                var expected [NonceLen]byte
+                binary.BigEndian.PutUint64(expected[:], uint64(41+i))
+                if nonce := frames[start+HeaderLen : start+HeaderLen+NonceLen]; !bytes.Equal(nonce, expected[:]) {
+                        t.Fatalf("Frame %d: unexpected nonce %x, expected %x", i, nonce, expected)
+                }
+        }
+
+        got, err := ioutil.ReadAll(NewSecureReader(&wire, priv, pub))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got) != "helloworld" {
+                t.Fatalf("Unexpected result: %q != %q", got, "helloworld")
+        }
+}
+
+func TestMoreSplitHello(t *testing.T) {
+        clientPub, serverPub := &[32]byte{'c'}, &[32]byte{'s'}
+
+        legacy := string(protocolHandshake) + string(clientPub[:])
+        negotiate := string(negotiateHandshake) + "\x01\x14" + legacy
+        for _, hello := range []string{legacy, negotiate} {
+                // The client sends its hello a byte at a time.
+                client, server := net.Pipe()
+                go func() {
+                        for i := range hello {
+                                if _, err := io.WriteString(client, hello[i:i+1]); err != nil {
+                                        return
+                                }
+                        }
+                        io.Copy(ioutil.Discard, client)
+                }()
+
+                key, version, err := serverHandshake(server, serverPub, nil)
+                if err != nil {
+                        t.Fatalf("%q: %v", hello, err)
+                }
+                if *key != *clientPub || !bytes.Equal(version, protocolHandshake) {
+                        t.Fatalf("%q: unexpected key %x and version %q", hello, *key, version)
+                }
+                client.Close()
+                server.Close()
+        }
+
+        // A mismatch is detected without waiting for a whole hello.
+        client, server := net.Pipe()
+        defer client.Close()
+        go func() {
+                client.Write([]byte("hello\n"))
+                io.Copy(ioutil.Discard, client)
+        }()
+        if _, _, err := serverHandshake(server, serverPub, nil); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+        server.Close()
+}
+
+func TestMoreMultiWriter(t *testing.T) {
+        writerPub, writerPriv, _ := box.GenerateKey(rand.Reader)
+        var privs, pubs []*[32]byte
+        for i := 0; i < 3; i++ {
+                pub, priv, _ := box.GenerateKey(rand.Reader)
+                privs, pubs = append(privs, priv), append(pubs, pub)
+        }
+
+        var wire bytes.Buffer
+        mw, err := NewMultiWriter(&wire, writerPriv, pubs)
+        if err != nil {
+                t.Fatal(err)
+        }
+        expected := "hello world\n"
+        if _, err := fmt.Fprint(mw, expected); err != nil {
+                t.Fatal(err)
+        }
+        if wire.Len() != len(expected)+MsgOverhead+1+len(pubs)*wrappedKeyLen {
+                t.Fatalf("Unexpected frame length %d", wire.Len())
+        }
+
+        for i, priv := range privs {
+                got, err := ioutil.ReadAll(NewSecureReader(bytes.NewReader(wire.Bytes()), priv, writerPub))
+                if err != nil {
+                        t.Fatalf("Recipient %d: %v", i, err)
+                }
+                if string(got) != expected {
+                        t.Fatalf("Recipient %d: unexpected result: %q != %q", i, got, expected)
+                }
+        }
+
+        _, otherPriv, _ := box.GenerateKey(rand.Reader)
+        if _, err := ioutil.ReadAll(NewSecureReader(&wire, otherPriv, writerPub)); !errors.Is(err, ErrDecryptionError) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrDecryptionError)
+        }
+
+        // The largest frames don't fit in the pooled buffers.
+        many := make([]*[32]byte, MaxRecipients)
+        for i := range many {
+                many[i] = pubs[0]
+        }
+        mw, err = NewMultiWriter(&wire, writerPriv, many)
+        if err != nil {
+                t.Fatal(err)
+        }
+        msg := bytes.Repeat([]byte{'x'}, MaxMsgLen)
+        if _, err := mw.Write(msg); err != nil {
+                t.Fatal(err)
+        }
+        got, err := NewSecureReader(&wire, privs[0], writerPub).NextMessage()
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !bytes.Equal(got, msg) {
+                t.Fatal("Unexpected result")
+        }
+
+        if _, err := NewMultiWriter(&wire, writerPriv, make([]*[32]byte, MaxRecipients+1)); err != ErrTooManyRecipients {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrTooManyRecipients)
+        }
+}
+
+func TestMoreSequencedFrames(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        // Write every frame separately to drop or reorder them.
+        var frames [][]byte
+        var wire bytes.Buffer
+        secureW := NewSecureWriterSequenced(&wire, priv, pub)
+        for _, msg := range []string{"one", "two", "three"} {
+                if _, err := secureW.Write([]byte(msg)); err != nil {
+                        t.Fatal(err)
+                }
+                frames = append(frames, append([]byte(nil), wire.Bytes()...))
+                wire.Reset()
+        }
+
+        tData := []struct {
+                order     []int
+                sequenced bool
+                expected  string
+                err       error
+        }{
+                {[]int{0, 1, 2}, true, "onetwothree", nil},
+                {[]int{0, 2}, true, "one", ErrSequenceGap},
+                {[]int{1, 0, 2}, true, "", ErrSequenceGap},
+                {[]int{0, 2}, false, "onethree", nil},
+        }
+
+        for _, exp := range tData {
+                wire.Reset()
+                for _, i := range exp.order {
+                        wire.Write(frames[i])
+                }
+                secureR := NewSecureReader(&wire, priv, pub)
+                if exp.sequenced {
+                        secureR = NewSecureReaderSequenced(&wire, priv, pub)
+                }
+                got, err := ioutil.ReadAll(secureR)
+                if err != exp.err || string(got) != exp.expected {
+                        t.Fatalf("%v: got %q and %v, expected %q and %v", exp.order, got, err, exp.expected, exp.err)
+                }
+        }
+
+        // Frames without sequence numbers can't be checked.
+        wire.Reset()
+        fmt.Fprint(NewSecureWriter(&wire, priv, pub), "hello")
+        if _, err := NewSecureReaderSequenced(&wire, priv, pub).Read(make([]byte, 16)); err != ErrSequenceGap {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrSequenceGap)
+        }
+}
+
+func TestMoreWriteString(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var wire bytes.Buffer
+        var w io.StringWriter = NewSecureWriter(&wire, priv, pub)
+        expected := strings.Repeat("hello world\n", 1000)
+        if n, err := w.WriteString(expected); err != nil || n != len(expected) {
+                t.Fatalf("Unexpected result: %d, %v", n, err)
+        }
+        if _, err := w.WriteString(strings.Repeat("x", MaxMsgLen+1)); err != ErrMessageTooLarge {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrMessageTooLarge)
+        }
+
+        got, err := NewSecureReader(&wire, priv, pub).NextMessage()
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(got) != expected {
+                t.Fatalf("Unexpected message of %d bytes, expected %d", len(got), len(expected))
+        }
+}
+
+func TestMoreFrameHandler(t *testing.T) {
+        priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+        var wire bytes.Buffer
+        secureW := NewSecureWriter(&wire, priv, pub)
+        type frame struct {
+                nonce [NonceLen]byte
+                len   int
+        }
+        var frames []frame
+        secureW.SetFrameHandler(func(nonce [NonceLen]byte, plaintextLen int) {
+                frames = append(frames, frame{nonce, plaintextLen})
+        })
+        for _, msg := range []string{"hello", "world!"} {
+                secureW.WriteString(msg)
+        }
+        secureW.WritePing()
+
+        if len(frames) != 3 {
+                t.Fatalf("Got %d frames, expected 3", len(frames))
+        }
+        wireBytes := wire.Bytes()
+        for i, f := range frames {
+                if nonce := wireBytes[HeaderLen : HeaderLen+NonceLen]; !bytes.Equal(nonce, f.nonce[:]) {
+                        t.Fatalf("Frame %d: reported nonce %x, sent %x", i, f.nonce, nonce)
+                }
+                wireBytes = wireBytes[f.len+MsgOverhead:]
+        }
+        if len(wireBytes) != 0 || frames[0].len != 5 || frames[1].len != 6 {
+                t.Fatalf("Unexpected frame lengths %v", frames)
+        }
+}
+
+// brokenConn accepts limit bytes, then fails every write.
+type brokenConn struct {
+        net.Conn
+        limit int
+}
+
+func (c *brokenConn) Write(b []byte) (int, error) {
+        if len(b) > c.limit {
+                n := c.limit
+                c.limit = 0
+                return n, io.ErrClosedPipe
+        }
+        c.limit -= len(b)
+        return len(b), nil
+}
+
+func TestMoreHandshakeSendStage(t *testing.T) {
+        pub := &[32]byte{'c'}
+
+        tData := []struct {
+                limit int
+                stage string
+        }{
+                {0, stageSendHello},
+                {len(protocolHandshake) - 1, stageSendHello},
+                {len(protocolHandshake), stageSendKey},
+                {len(protocolHandshake) + 16, stageSendKey},
+        }
+
+        for _, exp := range tData {
+                client, server := net.Pipe()
+                _, _, err := clientHandshake(&brokenConn{client, exp.limit}, pub, protocolVersions, nil)
+                var herr *HandshakeError
+                if !errors.As(err, &herr) || herr.Stage != exp.stage || herr.Err != io.ErrClosedPipe {
+                        t.Fatalf("Limit %d: got %v, expected a %s failure", exp.limit, err, exp.stage)
+                }
+                client.Close()
+                server.Close()
+        }
+}
+
+func TestMoreConcurrentClose(t *testing.T) {
+        client, server, err := Pipe()
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer server.Close()
+
+        errc := make(chan error, 1)
+        go func() {
+                _, err := client.Read(make([]byte, 16))
+                errc <- err
+        }()
+        time.Sleep(10 * time.Millisecond)
+
+        var wg sync.WaitGroup
+        for i := 0; i < 4; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        if err := client.Close(); err != nil {
+                                t.Errorf("Unexpected error: %v", err)
+                        }
+                }()
+        }
+        wg.Wait()
+
+        select {
+        case err := <-errc:
+                if err != io.ErrClosedPipe {
+                        t.Fatalf("Unexpected error: got %v, expected %v", err, io.ErrClosedPipe)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("Read still blocked after Close")
+        }
+        if _, err := client.Read(make([]byte, 16)); err != io.ErrClosedPipe {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, io.ErrClosedPipe)
+        }
+}
+
+func TestMoreDialer(t *testing.T) {
+        pub, priv, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        peers := make(chan *[32]byte, 1)
+        s := &Server{Handler: func(rwc io.ReadWriteCloser) {
+                peers <- rwc.(Conn).PeerPublicKey()
+                EchoHandler(rwc)
+        }}
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        var events []EventKind
+        d := &Dialer{
+                ClientKey: priv,
+                Logger: LoggerFunc(func(e Event) {
+                        events = append(events, e.Kind)
+                }),
+        }
+        conn, err := d.Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := <-peers; *got != *pub {
+                t.Fatalf("Unexpected client key: %x != %x", *got, *pub)
+        }
+        fmt.Fprint(conn, "hello")
+        if _, err := conn.Read(make([]byte, 16)); err != nil {
+                t.Fatal(err)
+        }
+        conn.Close()
+        expected := []EventKind{EventHandshakeStart, EventKeyReceived, EventFrameWritten, EventFrameRead}
+        if fmt.Sprint(events) != fmt.Sprint(expected) {
+                t.Fatalf("Unexpected events %v, expected %v", events, expected)
+        }
+
+        // The zero value dials like Dial.
+        conn, err = (&Dialer{}).Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        <-peers
+        conn.Close()
+
+        d = &Dialer{PinnedServerKey: &[32]byte{'o', 't', 'h', 'e', 'r'}}
+        if _, err := d.Dial(l.Addr().String()); err != ErrKeyMismatch {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrKeyMismatch)
+        }
+}
+
+func TestMoreServerKey(t *testing.T) {
+        pub, priv, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        l, err := net.Listen("tcp", ":0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+
+        events := make(chan EventKind, 16)
+        s := &Server{
+                ServerKey: priv,
+                Logger: LoggerFunc(func(e Event) {
+                        events <- e.Kind
+                }),
+        }
+        go s.Serve(l)
+        defer s.Shutdown(context.Background())
+
+        conn, err := (&Dialer{PinnedServerKey: pub}).Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        if <-events != EventHandshakeStart || <-events != EventKeyReceived {
+                t.Fatal("Unexpected handshake events")
+        }
+        fmt.Fprint(conn, "hello")
+        if _, err := conn.Read(make([]byte, 16)); err != nil {
+                t.Fatal(err)
+        }
+        if <-events != EventFrameRead || <-events != EventFrameWritten {
+                t.Fatal("Unexpected echo events")
+        }
+}
+
+func TestMoreSession(t *testing.T) {
+        client, server := net.Pipe()
+        defer client.Close()
+        defer server.Close()
+
+        accepted := make(chan *Session, 1)
+        go func() {
+                conn, err := WrapServer(server)
+                if err != nil {
+                        close(accepted)
+                        return
+                }
+                s := NewSession(conn, false)
+                accepted <- s
+                // Echo every stream opened by the client.
+                for {
+                        st, err := s.AcceptStream()
+                        if err != nil {
+                                return
+                        }
+                        go func() {
+                                io.Copy(st, st)
+                                st.Close()
+                        }()
+                }
+        }()
+
+        conn, err := WrapClient(client)
+        if err != nil {
+                t.Fatal(err)
+        }
+        s := NewSession(conn, true)
+        defer s.Close()
+        serverSession := <-accepted
+        if serverSession == nil {
+                t.Fatal("Server handshake failed")
+        }
+
+        // Streams are independent, and writes larger than a message are
+        // split.
+        one, err := s.OpenStream()
+        if err != nil {
+                t.Fatal(err)
+        }
+        two, err := s.OpenStream()
+        if err != nil {
+                t.Fatal(err)
+        }
+        long := bytes.Repeat([]byte("0123456789"), MaxMsgLen/5)
+        go func() {
+                two.Write(long)
+                one.Write([]byte("hello"))
+        }()
+        got := make([]byte, 5)
+        if _, err := io.ReadFull(one, got); err != nil || string(got) != "hello" {
+                t.Fatalf("Unexpected result: got %q, %v", got, err)
+        }
+        got = make([]byte, len(long))
+        if _, err := io.ReadFull(two, got); err != nil || !bytes.Equal(got, long) {
+                t.Fatalf("Unexpected result: got %d bytes, %v", len(got), err)
+        }
+
+        // Closing a stream ends it on both sides.
+        one.Close()
+        if _, err := one.Write([]byte("x")); err != ErrStreamClosed {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrStreamClosed)
+        }
+
+        // The server opens streams too.
+        go func() {
+                st, err := serverSession.OpenStream()
+                if err != nil {
+                        return
+                }
+                fmt.Fprint(st, "from the server")
+                st.Close()
+        }()
+        st, err := s.AcceptStream()
+        if err != nil {
+                t.Fatal(err)
+        }
+        all, err := ioutil.ReadAll(st)
+        if err != nil || string(all) != "from the server" {
+                t.Fatalf("Unexpected result: got %q, %v", all, err)
+        }
+
+        s.Close()
+        if _, err := two.Read(got); err == nil {
+                t.Fatal("Expected an error reading a stream of a closed session")
+        }
+}
+
+func TestMoreSessionForgetsStreams(t *testing.T) {
+        client, server := net.Pipe()
+        defer client.Close()
+        defer server.Close()
+
+        accepted := make(chan Conn, 1)
+        go func() {
+                conn, _ := WrapServer(server)
+                accepted <- conn
+        }()
+        conn, err := WrapClient(client)
+        if err != nil {
+                t.Fatal(err)
+        }
+        serverConn := <-accepted
+        if serverConn == nil {
+                t.Fatal("The server handshake failed")
+        }
+        one, two := NewSession(conn, true), NewSession(serverConn, false)
+        defer one.Close()
+
+        // streams waits for s to track n streams.
+        streams := func(s *Session, n int) {
+                t.Helper()
+                for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+                        s.mu.Lock()
+                        got := len(s.streams)
+                        s.mu.Unlock()
+                        if got == n {
+                                return
+                        }
+                }
+                t.Fatalf("Unexpected streams: expected %d", n)
+        }
+
+        st, err := one.OpenStream()
+        if err != nil {
+                t.Fatal(err)
+        }
+        peer, err := two.AcceptStream()
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        // A stream closed by the peer only is kept.
+        peer.Close()
+        if _, err := ioutil.ReadAll(st); err != nil {
+                t.Fatal(err)
+        }
+        streams(one, 1)
+        streams(two, 1)
+
+        // Once closed on both sides, it is forgotten by both.
+        st.Close()
+        streams(one, 0)
+        streams(two, 0)
+}
+
+func TestMoreDialAuto(t *testing.T) {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+        // A plaintext server answering "ping" with "pong", and anything
+        // else with badHandshakeResponse.
+        go func() {
+                for {
+                        c, err := l.Accept()
+                        if err != nil {
+                                return
+                        }
+                        go func() {
+                                defer c.Close()
+                                buf := make([]byte, 4)
+                                for {
+                                        if _, err := io.ReadFull(c, buf); err != nil {
+                                                return
+                                        }
+                                        if string(buf) != "ping" {
+                                                c.Write(badHandshakeResponse)
+                                                // Closing with unread data would reset the connection.
+                                                io.Copy(ioutil.Discard, c)
+                                                return
+                                        }
+                                        c.Write([]byte("pong"))
+                                }
+                        }()
+                }
+        }()
+
+        if _, err := Dial(l.Addr().String()); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+
+        var events []EventKind
+        d := &Dialer{
+                InsecureFallback: true,
+                Logger: LoggerFunc(func(e Event) {
+                        events = append(events, e.Kind)
+                }),
+        }
+        conn, err := d.Dial(l.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        if !conn.Insecure() || conn.PeerPublicKey() != nil {
+                t.Fatal("Expected an insecure connection")
+        }
+        if events[len(events)-1] != EventInsecureFallback {
+                t.Fatalf("Unexpected events: %v", events)
+        }
+        fmt.Fprint(conn, "ping")
+        got := make([]byte, 4)
+        if _, err := io.ReadFull(conn, got); err != nil || string(got) != "pong" {
+                t.Fatalf("Unexpected result: got %q, %v", got, err)
+        }
+
+        // Expecting a key rules the fallback out.
+        d = &Dialer{InsecureFallback: true, PinnedServerKey: &[32]byte{1}}
+        if _, err := d.Dial(l.Addr().String()); !errors.Is(err, ErrBadHandshake) {
+                t.Fatalf("Unexpected error: got %v, expected %v", err, ErrBadHandshake)
+        }
+}
+
+func TestMoreDialAutoFailures(t *testing.T) {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer l.Close()
+        // The first connection is left unanswered, the second reset.
+        go func() {
+                stalled, err := l.Accept()
+                if err != nil {
+                        return
+                }
+                defer stalled.Close()
+                reset, err := l.Accept()
+                if err != nil {
+                        return
+                }
+                io.ReadFull(reset, make([]byte, len(protocolHandshake)))
+                reset.(*net.TCPConn).SetLinger(0)
+                reset.Close()
+                // Fallback connections would be accepted and left alone.
+                for {
+                        c, err := l.Accept()
+                        if err != nil {
+                                return
+                        }
+                        defer c.Close()
+                }
+        }()
+
+        d := &Dialer{InsecureFallback: true, Timeout: 50 * time.Millisecond}
+        conn, err := d.Dial(l.Addr().String())
+        var ne net.Error
+        if !errors.As(err, &ne) || !ne.Timeout() {
+                t.Fatalf("Unexpected result: got %v, %v, expected a timeout", conn, err)
+        }
+        conn, err = d.Dial(l.Addr().String())
+        if err == nil || errors.Is(err, errProtocolMismatch) {
+                t.Fatalf("Unexpected result: got %v, %v, expected a reset", conn, err)
+        }
+}
+
+func TestMoreDrain(t *testing.T) {
+        client, server := net.Pipe()
+        defer client.Close()
+
+        done := make(chan error, 1)
+        go func() {
+                conn, err := WrapServer(server)
+                if err != nil {
+                        done <- err
+                        return
+                }
+                if _, err := conn.Read(make([]byte, 16)); err != nil {
+                        done <- err
+                        return
+                }
+                done <- conn.Drain(time.Second)
+        }()
+
+        conn, err := WrapClient(client)
+        if err != nil {
+                t.Fatal(err)
+        }
+        // net.Pipe is unbuffered, so the writes only return once read.
+        for i := 0; i < 3; i++ {
+                if _, err := fmt.Fprint(conn, "hello"); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        conn.Close()
+        if err := <-done; err != nil {
+                t.Fatal(err)
+        }
+
+        // Draining a peer that never ends stops after the delay.
+        client, server = net.Pipe()
+        defer client.Close()
+        go WrapServer(server)
+        conn, err = WrapClient(client)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if err := conn.Drain(10 * time.Millisecond); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := conn.Write([]byte("hello")); err == nil {
+                t.Fatal("Expected the connection to be closed")
+        }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+        "crypto/rand"
+        "errors"
+        "io"
+        "sync"
+
+        "golang.org/x/crypto/nacl/box"
+)
+
+const (
+        // MaxRecipients is the largest number of recipients of a MultiWriter.
+        MaxRecipients = 255
+
+        // wrappedKeyLen is the size of a message key sealed for one recipient.
+        wrappedKeyLen = 32 + BoxOverhead
+)
+
+// ErrTooManyRecipients is returned when a MultiWriter is given more than
+// MaxRecipients recipients.
+var ErrTooManyRecipients = errors.New("too many recipients")
+
+// MultiWriter encrypts every message once for several recipients, each
+// reading the frames with a SecureReader using its own key pair and the
+// writer public key.
+//
+// Every message is sealed with a fresh random message key, itself sealed
+// for each recipient with the key it shares with the writer. Recipients
+// can't forge messages from the writer, but any recipient receiving a
+// frame first could replace its message before it reaches the others.
+type MultiWriter struct {
+        mu   sync.Mutex
+        w    io.Writer
+        keys [][32]byte // shared with each recipient
+        rand io.Reader  // source of the nonces and message keys
+}
+
+// NewMultiWriter instantiates a new MultiWriter writing to w the messages
+// of the owner of priv for the owners of the recipients public keys.
+func NewMultiWriter(w io.Writer, priv *[32]byte, recipients []*[32]byte) (*MultiWriter, error) {
+        if len(recipients) > MaxRecipients {
+                return nil, ErrTooManyRecipients
+        }
+        mw := &MultiWriter{w: w, keys: make([][32]byte, len(recipients)), rand: rand.Reader}
+        for i, pub := range recipients {
+                box.Precompute(&mw.keys[i], pub, priv)
+        }
+        return mw, nil
+}
+
+// Write encrypts p for every recipient and writes it as one frame.
+func (mw *MultiWriter) Write(p []byte) (int, error) {
+        if len(p) == 0 {
+                return 0, nil
+        }
+        if len(p) > MaxMsgLen {
+                return 0, ErrMessageTooLarge
+        }
+        mw.mu.Lock()
+        defer mw.mu.Unlock()
+
+        n := 1 + len(mw.keys)*wrappedKeyLen + len(p) + BoxOverhead
+        buf := getFrame(HeaderLen + NonceLen + n)
+        defer putFrame(buf)
+
+        frame := (*buf)[:HeaderLen+NonceLen]
+        putHeader(frame, flagMulti, n)
+        if _, err := io.ReadFull(mw.rand, frame[HeaderLen:]); err != nil {
+                return 0, err
+        }
+        var msgKey [32]byte
+        if _, err := io.ReadFull(mw.rand, msgKey[:]); err != nil {
+                return 0, err
+        }
+        var nonce [NonceLen]byte
+        copy(nonce[:], frame[HeaderLen:])
+        nonce = sealNonce(nonce, frameVersion, flagMulti)
+
+        frame = append(frame, byte(len(mw.keys)))
+        for i := range mw.keys {
+                frame = box.SealAfterPrecomputation(frame, msgKey[:], &nonce, &mw.keys[i])
+        }
+        frame = box.SealAfterPrecomputation(frame, p, &nonce, &msgKey)
+        if _, err := mw.w.Write(frame); err != nil {
+                return 0, err
+        }
+        logEvent(nil, EventFrameWritten, len(frame))
+        return len(p), nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+        "encoding/binary"
+        "errors"
+        "io"
+        "sync"
+)
+
+// Kinds of the messages exchanged by a Session.
+const (
+        muxOpen byte = iota
+        muxData
+        muxClose
+)
+
+// muxHeaderLen is the size of the stream ID and message kind prefixed to
+// every message of a Session.
+const muxHeaderLen = 5
+
+var (
+        // ErrStreamClosed is returned when using a stream closed locally.
+        ErrStreamClosed = errors.New("stream closed")
+
+        // ErrBadStreamMessage is returned when the peer of a Session sends
+        // a message that doesn't follow the protocol.
+        ErrBadStreamMessage = errors.New("bad stream message")
+)
+
+// Session multiplexes logical streams over a single Conn. Every message
+// sent on the Conn starts with the ID of its stream, 4 bytes big endian,
+// and its kind: open, data or close. The client opens streams with odd
+// IDs, the server with even ones, so the two never clash.
+//
+// There is no flow control: the data received on a stream is buffered
+// until it is read.
+type Session struct {
+        conn Conn
+
+        mu      sync.Mutex
+        cond    sync.Cond          // signaled on any change below
+        streams map[uint32]*stream // until closed on both sides
+        nextID  uint32
+        backlog []*stream // opened by the peer, not yet accepted
+        err     error     // set once the Conn fails
+}
+
+// NewSession starts multiplexing streams over c. client tells the two
+// sides of c apart, and must be true on exactly one of them. The Session
+// reads c until it fails or is closed.
+func NewSession(c Conn, client bool) *Session {
+        s := &Session{
+                conn:    c,
+                streams: make(map[uint32]*stream),
+                nextID:  2,
+        }
+        if client {
+                s.nextID = 1
+        }
+        s.cond.L = &s.mu
+        go s.readLoop()
+        return s
+}
+
+// OpenStream opens a stream, returned by AcceptStream on the other side.
+func (s *Session) OpenStream() (io.ReadWriteCloser, error) {
+        s.mu.Lock()
+        if s.err != nil {
+                s.mu.Unlock()
+                return nil, s.err
+        }
+        st := &stream{s: s, id: s.nextID}
+        s.nextID += 2
+        s.streams[st.id] = st
+        s.mu.Unlock()
+
+        if err := s.send(st.id, muxOpen, nil); err != nil {
+                return nil, err
+        }
+        return st, nil
+}
+
+// AcceptStream waits for the next stream opened by the other side.
+func (s *Session) AcceptStream() (io.ReadWriteCloser, error) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        for len(s.backlog) == 0 && s.err == nil {
+                s.cond.Wait()
+        }
+        if len(s.backlog) == 0 {
+                return nil, s.err
+        }
+        st := s.backlog[0]
+        s.backlog = s.backlog[1:]
+        return st, nil
+}
+
+// Close closes the underlying Conn, making every stream fail.
+func (s *Session) Close() error {
+        return s.conn.Close()
+}
+
+// send writes a message of stream id.
+func (s *Session) send(id uint32, kind byte, data []byte) error {
+        msg := make([]byte, muxHeaderLen+len(data))
+        binary.BigEndian.PutUint32(msg, id)
+        msg[4] = kind
+        copy(msg[muxHeaderLen:], data)
+        _, err := s.conn.Write(msg)
+        return err
+}
+
+// readLoop dispatches the messages read from the Conn to their streams.
+func (s *Session) readLoop() {
+        buf := make([]byte, MaxMsgLen)
+        for {
+                n, err := s.conn.Read(buf)
+                if err == nil && n < muxHeaderLen {
+                        err = ErrBadStreamMessage
+                }
+                s.mu.Lock()
+                if err == nil {
+                        err = s.dispatch(binary.BigEndian.Uint32(buf), buf[4], buf[muxHeaderLen:n])
+                }
+                if err != nil {
+                        s.err = err
+                        s.cond.Broadcast()
+                        s.mu.Unlock()
+                        return
+                }
+                s.cond.Broadcast()
+                s.mu.Unlock()
+        }
+}
+
+// dispatch handles a message of stream id. s.mu must be held.
+func (s *Session) dispatch(id uint32, kind byte, data []byte) error {
+        st := s.streams[id]
+        switch kind {
+        case muxOpen:
+                // The peer opens the IDs of the other parity.
+                if st != nil || id%2 == s.nextID%2 {
+                        return ErrBadStreamMessage
+                }
+                st = &stream{s: s, id: id}
+                s.streams[id] = st
+                s.backlog = append(s.backlog, st)
+        case muxData:
+                // Streams closed locally drop their data.
+                if st != nil && !st.closed {
+                        st.buf = append(st.buf, data...)
+                }
+        case muxClose:
+                if st != nil {
+                        st.eof = true
+                        s.forget(st)
+                }
+        default:
+                return ErrBadStreamMessage
+        }
+        return nil
+}
+
+// forget removes st from the streams once closed on both sides, keeping
+// its ID from being opened again until then. s.mu must be held.
+func (s *Session) forget(st *stream) {
+        if st.eof && st.closed {
+                delete(s.streams, st.id)
+        }
+}
+
+// stream is a logical stream of a Session.
+type stream struct {
+        s  *Session
+        id uint32
+
+        // Guarded by s.mu.
+        buf    []byte // received, not yet read
+        eof    bool   // closed by the peer
+        closed bool   // closed locally
+}
+
+// Read reads the data received on the stream, returning io.EOF once the
+// peer closed it and everything was read.
+func (st *stream) Read(p []byte) (int, error) {
+        s := st.s
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        for len(st.buf) == 0 && !st.eof && !st.closed && s.err == nil {
+                s.cond.Wait()
+        }
+        switch {
+        case st.closed:
+                return 0, ErrStreamClosed
+        case len(st.buf) > 0:
+                n := copy(p, st.buf)
+                st.buf = st.buf[n:]
+                return n, nil
+        case st.eof:
+                return 0, io.EOF
+        }
+        return 0, s.err
+}
+
+// Write sends p on the stream, in as many messages as needed.
+func (st *stream) Write(p []byte) (int, error) {
+        st.s.mu.Lock()
+        closed := st.closed
+        st.s.mu.Unlock()
+        if closed {
+                return 0, ErrStreamClosed
+        }
+        written := 0
+        for written < len(p) {
+                n := len(p) - written
+                if n > MaxMsgLen-muxHeaderLen {
+                        n = MaxMsgLen - muxHeaderLen
+                }
+                if err := st.s.send(st.id, muxData, p[written:written+n]); err != nil {
+                        return written, err
+                }
+                written += n
+        }
+        return written, nil
+}
+
+// Close closes the stream in both directions. The peer reads io.EOF once
+// it has read the data already sent.
+func (st *stream) Close() error {
+        s := st.s
+        s.mu.Lock()
+        if st.closed {
+                s.mu.Unlock()
+                return nil
+        }
+        st.closed = true
+        st.buf = nil
+        s.forget(st)
+        s.cond.Broadcast()
+        s.mu.Unlock()
+        return s.send(st.id, muxClose, nil)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+        "crypto/rand"
+        "io"
+        "net"
+        "sync"
+
+        "golang.org/x/crypto/nacl/box"
+)
+
+const (
+        // maxPacketLen is the size of the largest UDP payload over IPv4.
+        maxPacketLen = 65507
+
+        // maxPacketMsgLen is the size of the largest message sent in a
+        // datagram, which holds the nonce and the box.
+        maxPacketMsgLen = maxPacketLen - NonceLen - BoxOverhead
+)
+
+// securePacketConn encrypts every datagram written to a PacketConn into a
+// self-contained box prefixed by its nonce.
+type securePacketConn struct {
+        net.PacketConn
+        key  [32]byte
+        rand io.Reader
+
+        mu  sync.Mutex // guards buf and out
+        buf []byte     // holds the datagram being read
+        out []byte     // holds its plaintext
+}
+
+// NewSecurePacketConn secures the datagrams sent and received on pc with
+// the keys of the two peers. Datagrams failing authentication are dropped
+// by ReadFrom. Unlike the stream transport, datagrams may be lost,
+// reordered or replayed.
+func NewSecurePacketConn(pc net.PacketConn, priv, peerPub *[32]byte) net.PacketConn {
+        c := &securePacketConn{
+                PacketConn: pc,
+                rand:       rand.Reader,
+                buf:        make([]byte, maxPacketLen),
+                out:        make([]byte, 0, maxPacketLen),
+        }
+        box.Precompute(&c.key, peerPub, priv)
+        return c
+}
+
+// ReadFrom reads the next authentic datagram into p, silently truncating
+// it if p is too small.
+func (c *securePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        for {
+                n, addr, err := c.PacketConn.ReadFrom(c.buf)
+                if err != nil {
+                        return 0, addr, err
+                }
+                if n < NonceLen+BoxOverhead {
+                        continue
+                }
+                var nonce [NonceLen]byte
+                copy(nonce[:], c.buf[:NonceLen])
+                msg, ok := box.OpenAfterPrecomputation(c.out[:0], c.buf[NonceLen:n], &nonce, &c.key)
+                if !ok {
+                        continue
+                }
+                return copy(p, msg), addr, nil
+        }
+}
+
+// WriteTo encrypts p with a fresh random nonce and sends it as a single
+// datagram to addr.
+func (c *securePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+        if len(p) > maxPacketMsgLen {
+                return 0, ErrMessageTooLarge
+        }
+        var nonce [NonceLen]byte
+        if _, err := io.ReadFull(c.rand, nonce[:]); err != nil {
+                return 0, err
+        }
+        packet := make([]byte, NonceLen, NonceLen+len(p)+BoxOverhead)
+        copy(packet, nonce[:])
+        packet = box.SealAfterPrecomputation(packet, p, &nonce, &c.key)
+        if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+                return 0, err
+        }
+        return len(p), nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "errors"
+        "io"
+        "net"
+        "sync"
+        "time"
+
+        "golang.org/x/crypto/nacl/box"
+)
+
+var (
+        // ErrServerClosed is returned by Server.Serve after a call to
+        // Shutdown.
+        ErrServerClosed = errors.New("server closed")
+
+        // ErrConnBytesExceeded is returned to handlers reading from a
+        // connection which has read Server.MaxConnBytes bytes.
+        ErrConnBytesExceeded = errors.New("connection byte limit reached")
+)
+
+// Server is a secure server. The zero value is an echo server ready to
+// use.
+type Server struct {
+        // Handler is called with every secured connection, which is closed
+        // when it returns. If nil, EchoHandler is used.
+        Handler func(io.ReadWriteCloser)
+
+        // MaxConns caps the number of connections served at once. Once
+        // reached, no connection is accepted until one finishes. Zero means
+        // no limit.
+        MaxConns int
+
+        // HandshakeTimeout is the time allowed to a client to complete the
+        // handshake. Zero means DefaultHandshakeTimeout.
+        HandshakeTimeout time.Duration
+
+        // IdleTimeout is the time a handler may wait for data from the client
+        // in a single read before the connection is closed. Zero means no
+        // timeout.
+        IdleTimeout time.Duration
+
+        // MaxConnBytes caps the number of bytes handlers may read from a
+        // connection. Once reached, reads fail with ErrConnBytesExceeded, and
+        // the connection is closed when the handler returns. Zero means no
+        // limit.
+        MaxConnBytes int64
+
+        // Identity is the long-term identity private key of the server, see
+        // DialAuth. If set, clients must authenticate with their own identity.
+        Identity *[32]byte
+
+        // AuthorizePeer reports whether to accept a client authenticated with
+        // the given identity public key. If nil, any identity is accepted. It
+        // is only used along with Identity.
+        AuthorizePeer func(identity *[32]byte) bool
+
+        // Rand is the source of the server key pair and of the nonces. If nil,
+        // crypto/rand.Reader is used.
+        Rand io.Reader
+
+        // ServerKey is the private key of the server, giving it a stable
+        // public key clients can pin with Dialer.PinnedServerKey. If nil, a
+        // key pair is generated by every call to Serve.
+        ServerKey *[32]byte
+
+        // Logger receives the events of the connections instead of
+        // DebugLogger, if not nil.
+        Logger Logger
+
+        mu        sync.Mutex
+        wg        sync.WaitGroup
+        closed    bool
+        done      chan struct{} // closed by Shutdown
+        listeners map[net.Listener]struct{}
+        conns     map[net.Conn]struct{}
+}
+
+// Serve accepts connections on l and hands them to the handler once
+// secured. It always returns a non-nil error; after Shutdown the
+// error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+        priv, pub, err := s.keys()
+        if err != nil {
+                return err
+        }
+        if !s.trackListener(l, true) {
+                return ErrServerClosed
+        }
+        defer s.trackListener(l, false)
+
+        var sem chan struct{}
+        if s.MaxConns > 0 {
+                sem = make(chan struct{}, s.MaxConns)
+        }
+        for {
+                if sem != nil {
+                        select {
+                        case sem <- struct{}{}:
+                        case <-s.doneChan():
+                                return ErrServerClosed
+                        }
+                }
+                conn, err := l.Accept()
+                if err != nil {
+                        if s.shuttingDown() {
+                                return ErrServerClosed
+                        }
+                        return err
+                }
+                if !s.trackConn(conn, true) {
+                        conn.Close()
+                        return ErrServerClosed
+                }
+                go func() {
+                        defer s.wg.Done()
+                        defer s.trackConn(conn, false)
+                        if sem != nil {
+                                defer func() { <-sem }()
+                        }
+                        s.serve(conn, priv, pub)
+                }()
+        }
+}
+
+// ServeLimit starts a secure echo server on the given listener, serving at
+// most maxConns connections at once.
+func ServeLimit(l net.Listener, maxConns int) error {
+        return (&Server{MaxConns: maxConns}).Serve(l)
+}
+
+// ServeFunc starts a secure server on the given listener, calling handler
+// with every secured connection.
+func ServeFunc(l net.Listener, handler func(io.ReadWriteCloser)) error {
+        return (&Server{Handler: handler}).Serve(l)
+}
+
+// EchoHandler writes back every message read from rw until the
+// connection fails.
+func EchoHandler(rw io.ReadWriteCloser) {
+        buf := make([]byte, MaxMsgLen)
+        for {
+                n, err := rw.Read(buf)
+                if err != nil {
+                        return
+                }
+                if _, err := rw.Write(buf[:n]); err != nil {
+                        return
+                }
+        }
+}
+
+// Shutdown stops accepting connections and waits for the active ones to
+// exit, or for ctx to be done. Connections waiting for a message are
+// interrupted.
+func (s *Server) Shutdown(ctx context.Context) error {
+        s.mu.Lock()
+        if !s.closed {
+                s.closed = true
+                close(s.doneChanLocked())
+        }
+        for l := range s.listeners {
+                l.Close()
+        }
+        // Wake up the connections waiting for a message.
+        for c := range s.conns {
+                c.SetReadDeadline(time.Now())
+        }
+        s.mu.Unlock()
+
+        done := make(chan struct{})
+        go func() {
+                s.wg.Wait()
+                close(done)
+        }()
+        select {
+        case <-done:
+                return nil
+        case <-ctx.Done():
+                return ctx.Err()
+        }
+}
+
+// serve performs the server handshake on c and runs the handler.
+func (s *Server) serve(c net.Conn, priv, pub *[32]byte) {
+        defer c.Close()
+        timeout := s.HandshakeTimeout
+        if timeout == 0 {
+                timeout = DefaultHandshakeTimeout
+        }
+        sc, err := wrapServer(c, priv, pub, s.auth(), timeout, s.rand(), s.Logger)
+        if err != nil {
+                return
+        }
+        // Clearing the handshake deadline could undo the wake up of a
+        // concurrent Shutdown, so check for it afterwards.
+        if s.shuttingDown() {
+                return
+        }
+        handler := s.Handler
+        if handler == nil {
+                handler = EchoHandler
+        }
+        if s.IdleTimeout > 0 {
+                sc = &idleConn{Conn: sc, s: s}
+        }
+        if s.MaxConnBytes > 0 {
+                sc = &limitedConn{Conn: sc, max: s.MaxConnBytes}
+        }
+        handler(sc)
+}
+
+// limitedConn fails reads once max bytes have been read.
+type limitedConn struct {
+        Conn
+        max int64
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+        left := c.max - c.BytesRead()
+        if left <= 0 {
+                return 0, ErrConnBytesExceeded
+        }
+        if int64(len(p)) > left {
+                p = p[:left]
+        }
+        return c.Conn.Read(p)
+}
+
+// idleConn sets the idle timeout of its server before every read.
+type idleConn struct {
+        Conn
+        s *Server
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+        c.Conn.SetReadDeadline(time.Now().Add(c.s.IdleTimeout))
+        // The deadline could undo the wake up of a concurrent Shutdown.
+        if c.s.shuttingDown() {
+                return 0, ErrServerClosed
+        }
+        return c.Conn.Read(p)
+}
+
+// WrapServer performs the server handshake over an established connection
+// with a new key pair, and secures it.
+func WrapServer(conn net.Conn) (Conn, error) {
+        pub, priv, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+                return nil, err
+        }
+        return wrapServer(conn, priv, pub, nil, DefaultHandshakeTimeout, rand.Reader, nil)
+}
+
+// wrapServer performs the server handshake over c within timeout using the
+// given key pair, and authenticates with auth if it isn't nil. The nonces
+// are read from random, and the events reported to logger.
+func wrapServer(c net.Conn, priv, pub *[32]byte, auth *authConfig, timeout time.Duration, random io.Reader, logger Logger) (Conn, error) {
+        c.SetDeadline(time.Now().Add(timeout))
+        // c is left to the caller either way, without a deadline.
+        defer c.SetDeadline(time.Time{})
+        clientPub, _, err := serverHandshake(c, pub, logger)
+        if err != nil {
+                return nil, err
+        }
+        sc := newSecureConn(c, priv, pub, clientPub, random, logger)
+        if auth != nil {
+                if err := auth.receive(sc); err != nil {
+                        return nil, err
+                }
+                if err := auth.send(sc); err != nil {
+                        return nil, err
+                }
+        }
+        return sc, nil
+}
+
+func (s *Server) auth() *authConfig {
+        if s.Identity == nil {
+                return nil
+        }
+        return newAuthConfig(s.Identity, s.AuthorizePeer)
+}
+
+// keys returns the key pair of the server, derived from ServerKey or
+// generated.
+func (s *Server) keys() (priv, pub *[32]byte, err error) {
+        if s.ServerKey == nil {
+                pub, priv, err = box.GenerateKey(s.rand())
+                return priv, pub, err
+        }
+        pub, err = publicKey(s.ServerKey)
+        return s.ServerKey, pub, err
+}
+
+func (s *Server) rand() io.Reader {
+        if s.Rand != nil {
+                return s.Rand
+        }
+        return rand.Reader
+}
+
+func (s *Server) doneChan() <-chan struct{} {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return s.doneChanLocked()
+}
+
+func (s *Server) doneChanLocked() chan struct{} {
+        if s.done == nil {
+                s.done = make(chan struct{})
+        }
+        return s.done
+}
+
+func (s *Server) shuttingDown() bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return s.closed
+}
+
+// trackListener adds or removes l from the active listeners. It reports
+// false if the server is shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if !add {
+                delete(s.listeners, l)
+                return true
+        }
+        if s.closed {
+                return false
+        }
+        if s.listeners == nil {
+                s.listeners = make(map[net.Listener]struct{})
+        }
+        s.listeners[l] = struct{}{}
+        return true
+}
+
+// trackConn adds or removes c from the active connections, adding it to
+// the wait group. It reports false if the server is shutting down.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if !add {
+                delete(s.conns, c)
+                return true
+        }
+        if s.closed {
+                return false
+        }
+        if s.conns == nil {
+                s.conns = make(map[net.Conn]struct{})
+        }
+        s.conns[c] = struct{}{}
+        s.wg.Add(1)
+        return true
+}
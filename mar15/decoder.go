@@ -1,15 +1,700 @@
 package drum
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrInvalidFileFormat is returned when the file does not start with
+	// the SPLICE marker.
+	ErrInvalidFileFormat = errors.New("drum: invalid file format")
+	// ErrInsufficientData is returned when the declared data length is too
+	// short to hold the pattern metadata or a declared track name.
+	ErrInsufficientData = errors.New("drum: insufficient data")
+	// ErrEmptyFile is returned when the file holds no data at all.
+	ErrEmptyFile = errors.New("drum: empty file")
+	// ErrInvalidTempo is returned when a tempo isn't a positive finite
+	// number.
+	ErrInvalidTempo = errors.New("drum: invalid tempo")
+	// ErrDuplicateID is returned when two tracks of a pattern would share
+	// the same ID.
+	ErrDuplicateID = errors.New("drum: duplicate track ID")
+	// ErrChecksumMismatch is returned when the data doesn't match its
+	// trailing checksum.
+	ErrChecksumMismatch = errors.New("drum: checksum mismatch")
+	// ErrLengthMismatch is returned in strict mode when the tracks don't
+	// end at the declared data length, or when data follows it.
+	ErrLengthMismatch = errors.New("drum: data length mismatch")
+)
+
+// spliceMagic is the marker every .splice file starts with.
+var spliceMagic = [6]byte{'S', 'P', 'L', 'I', 'C', 'E'}
+
+// stepCount is the number of steps stored per track.
+const stepCount = 16
+
+// header is the fixed size preamble of a .splice file.
+type header struct {
+	Magic      [6]byte
+	Padding    [7]byte
+	DataLength uint8
+}
+
+// patternInfo holds the pattern metadata that follows the header.
+type patternInfo struct {
+	Version [32]byte
+	Tempo   float32
+}
+
+// Options selects a variant of the file format.
+type Options struct {
+	// LongNames makes the track name lengths two bytes long, little
+	// endian, instead of one. The names still fit in the data length,
+	// which is a single byte.
+	LongNames bool
+
+	// Checksum makes the last four bytes of the data a little endian
+	// CRC-32 (IEEE) of the rest.
+	Checksum bool
+
+	// TrackTrailer is the size of the data following the steps of every
+	// track, kept in Track.Extra.
+	TrackTrailer int
+
+	// TempoFormat is the encoding of the tempo.
+	TempoFormat TempoFormat
+
+	// StrictLength requires the tracks to end exactly at the declared
+	// data length and the file to end with them, failing with
+	// ErrLengthMismatch otherwise. By default, data ending early on a
+	// track boundary and anything following the data are accepted.
+	StrictLength bool
+}
+
+// TempoFormat is an encoding of the pattern tempo.
+type TempoFormat int
+
+const (
+	// TempoFloat32 stores the tempo as a little endian float32.
+	TempoFloat32 TempoFormat = iota
+	// TempoUint16 stores the tempo as a little endian uint16, in whole
+	// beats per minute, as in older files.
+	TempoUint16
+)
+
+// infoLen returns the size of the pattern metadata.
+func (opts Options) infoLen() int {
+	if opts.TempoFormat == TempoUint16 {
+		return len(patternInfo{}.Version) + 2
+	}
+	return binary.Size(patternInfo{})
+}
+
+// checksumLen is the size of the trailing checksum.
+const checksumLen = 4
+
 // DecodeFile decodes the drum machine file found at the provided path
 // and returns a pointer to a parsed pattern which is the entry point to the
 // rest of the data.
-// TODO: implement
 func DecodeFile(path string) (*Pattern, error) {
-	p := &Pattern{}
+	return DecodeFileOptions(path, Options{})
+}
+
+// DecodeFileOptions is like DecodeFile for the format variant selected by
+// opts.
+func DecodeFileOptions(path string, opts Options) (*Pattern, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decode(f, opts)
+}
+
+// DecodeFiles decodes the drum machine files at paths, up to concurrency
+// at a time, and returns the patterns and errors in the order of paths.
+// Each file has either its pattern or its error set.
+func DecodeFiles(paths []string, concurrency int) ([]*Pattern, []error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	patterns := make([]*Pattern, len(paths))
+	errs := make([]error, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(paths); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				patterns[j], errs[j] = DecodeFile(paths[j])
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return patterns, errs
+}
+
+// DecodeAll decodes the bank of drum machine files concatenated in r until
+// it is exhausted.
+func DecodeAll(r io.Reader) ([]*Pattern, error) {
+	var patterns []*Pattern
+	_, err := DecodeAllProgress(r, func(p *Pattern, index int) {
+		patterns = append(patterns, p)
+	})
+	return patterns, err
+}
+
+// DecodeAllProgress is like DecodeAll but hands every pattern to onPattern,
+// along with its index in the bank, as soon as it is decoded. It returns
+// the number of patterns decoded, before the error if any.
+func DecodeAllProgress(r io.Reader, onPattern func(p *Pattern, index int)) (int, error) {
+	n := 0
+	for {
+		p, err := decode(r, Options{})
+		if err == ErrEmptyFile {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		onPattern(p, n)
+		n++
+	}
+}
+
+// decode decodes a pattern from r.
+func decode(r io.Reader, opts Options) (*Pattern, error) {
+	h, err := readHeader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	lr := &io.LimitedReader{R: r, N: int64(h.DataLength)}
+	if opts.Checksum {
+		data, err := readChecked(lr, int(h.DataLength), opts)
+		if err != nil {
+			return nil, err
+		}
+		lr = &io.LimitedReader{R: bytes.NewReader(data), N: int64(len(data))}
+	}
+
+	info, err := readInfo(lr, opts)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := readTracks(lr, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.StrictLength {
+		if lr.N != 0 {
+			return nil, ErrLengthMismatch
+		}
+		// Reading one more byte tells a surplus from the end of the file.
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err == nil {
+			return nil, ErrLengthMismatch
+		} else if err != io.EOF {
+			return nil, err
+		}
+	}
+
+	p := &Pattern{
+		Version:    getVersionAsString(info.Version[:]),
+		Tempo:      info.Tempo,
+		Tracks:     tracks,
+		rawVersion: info.Version[:],
+	}
 	return p, nil
 }
 
+// DecodeHeader returns the version and tempo stored in the drum machine
+// file found at the provided path, without reading the tracks.
+func DecodeHeader(path string) (version string, tempo float32, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	if _, err := readHeader(f, Options{}); err != nil {
+		return "", 0, err
+	}
+	var info patternInfo
+	if err := binary.Read(f, binary.LittleEndian, &info); err != nil {
+		return "", 0, err
+	}
+	return getVersionAsString(info.Version[:]), info.Tempo, nil
+}
+
+// CountTracks returns the number of tracks stored in the drum machine file
+// found at the provided path, without decoding the tracks themselves.
+func CountTracks(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h, err := readHeader(f, Options{})
+	if err != nil {
+		return 0, err
+	}
+	r := &io.LimitedReader{R: f, N: int64(h.DataLength)}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(binary.Size(patternInfo{}))); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		_, nameLen, err := readTrackHeader(r, Options{})
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return 0, err
+		}
+		skip := int64(nameLen) + stepCount
+		if skip > r.N {
+			return 0, ErrInsufficientData
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		n++
+	}
+}
+
+// readHeader reads and validates the file header.
+func readHeader(r io.Reader, opts Options) (*header, error) {
+	var h header
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		if err == io.EOF {
+			return nil, ErrEmptyFile
+		}
+		return nil, err
+	}
+	if h.Magic != spliceMagic {
+		return nil, ErrInvalidFileFormat
+	}
+	if int(h.DataLength) < opts.infoLen() {
+		return nil, ErrInsufficientData
+	}
+	return &h, nil
+}
+
+// readInfo reads the pattern metadata in the format selected by opts.
+func readInfo(r io.Reader, opts Options) (*patternInfo, error) {
+	var info patternInfo
+	if opts.TempoFormat != TempoUint16 {
+		if err := binary.Read(r, binary.LittleEndian, &info); err != nil {
+			return nil, err
+		}
+		return &info, nil
+	}
+	var tempo uint16
+	if _, err := io.ReadFull(r, info.Version[:]); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &tempo); err != nil {
+		return nil, err
+	}
+	info.Tempo = float32(tempo)
+	return &info, nil
+}
+
+// readChecked reads the n bytes of data from r and returns them without
+// their trailing checksum, once verified.
+func readChecked(r io.Reader, n int, opts Options) ([]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if len(data) < opts.infoLen()+checksumLen {
+		return nil, ErrInsufficientData
+	}
+	data, sum := data[:len(data)-checksumLen], data[len(data)-checksumLen:]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(sum) {
+		return nil, ErrChecksumMismatch
+	}
+	return data, nil
+}
+
+// readTrackHeader reads the ID and the name length preceding the name and
+// step data of a track.
+func readTrackHeader(r io.Reader, opts Options) (id uint32, nameLen int, err error) {
+	var buf [6]byte
+	n := 5
+	if opts.LongNames {
+		n = 6
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, 0, err
+	}
+	id = binary.LittleEndian.Uint32(buf[:4])
+	if opts.LongNames {
+		nameLen = int(binary.LittleEndian.Uint16(buf[4:]))
+	} else {
+		nameLen = int(buf[4])
+	}
+	return id, nameLen, nil
+}
+
+// readTracks reads tracks from r until it is exhausted. A track declaring
+// more data than r has left fails with ErrInsufficientData.
+func readTracks(r *io.LimitedReader, opts Options) ([]Track, error) {
+	var tracks []Track
+	for {
+		id, nameLen, err := readTrackHeader(r, opts)
+		if err != nil {
+			if err == io.EOF {
+				return tracks, nil
+			}
+			return nil, err
+		}
+		if int64(nameLen)+stepCount+int64(opts.TrackTrailer) > r.N {
+			return nil, ErrInsufficientData
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		var data Steps
+		if _, err := io.ReadFull(r, data[:]); err != nil {
+			return nil, err
+		}
+		var extra []byte
+		if opts.TrackTrailer > 0 {
+			extra = make([]byte, opts.TrackTrailer)
+			if _, err := io.ReadFull(r, extra); err != nil {
+				return nil, err
+			}
+		}
+		tracks = append(tracks, Track{
+			ID:    int(id),
+			RawID: id,
+			Name:  string(name),
+			Data:  data,
+			Extra: extra,
+		})
+	}
+}
+
+// getVersionAsString converts the zero padded version field to a string.
+func getVersionAsString(v []byte) string {
+	if i := bytes.IndexByte(v[:], 0); i >= 0 {
+		return string(v[:i])
+	}
+	return string(v[:])
+}
+
 // Pattern is the high level representation of the
 // drum pattern contained in a .splice file.
-// TODO: implement
-type Pattern struct{}
+type Pattern struct {
+	Version string
+	Tempo   float32
+	Tracks  []Track
+
+	// rawVersion is the version field as decoded, nil for patterns not
+	// read from a file.
+	rawVersion []byte
+}
+
+// RawVersion returns the 32-byte version field as stored in the file the
+// pattern was decoded from, including whatever follows the terminating
+// zero byte. If the pattern wasn't decoded, or Version was changed since,
+// it returns Version padded with zero bytes as EncodeFile writes it.
+func (p *Pattern) RawVersion() []byte {
+	raw := make([]byte, len(patternInfo{}.Version))
+	if p.rawVersion != nil && getVersionAsString(p.rawVersion) == p.Version {
+		copy(raw, p.rawVersion)
+	} else {
+		copy(raw, p.Version)
+	}
+	return raw
+}
+
+func (p *Pattern) String() string {
+	return p.Render('x', '-', '|')
+}
+
+// Render is like String, drawing the steps with the given symbols as
+// Steps.Render does.
+func (p *Pattern) Render(on, off, bar rune) string {
+	var buf bytes.Buffer
+	p.render(&buf, on, off, bar)
+	return buf.String()
+}
+
+// WriteTo writes the text returned by String to w, a line at a time. It
+// implements io.WriterTo.
+func (p *Pattern) WriteTo(w io.Writer) (int64, error) {
+	return p.render(w, 'x', '-', '|')
+}
+
+// render writes the text of Render to w.
+func (p *Pattern) render(w io.Writer, on, off, bar rune) (int64, error) {
+	n, err := p.renderHeader(w)
+	total := int64(n)
+	for i := range p.Tracks {
+		if err != nil {
+			break
+		}
+		n, err = p.Tracks[i].render(w, on, off, bar)
+		total += int64(n)
+	}
+	return total, err
+}
+
+// renderHeader writes the version and tempo lines of Render to w.
+func (p *Pattern) renderHeader(w io.Writer) (int, error) {
+	return fmt.Fprintf(w, "Saved with HW Version: %s\nTempo: %s\n", p.Version, p.StringTempo())
+}
+
+// render writes the line of t in Pattern.Render to w.
+func (t *Track) render(w io.Writer, on, off, bar rune) (int, error) {
+	if id, ok := t.storedID(); ok {
+		return fmt.Fprintf(w, "(%d) %s\t%s\n", id, t.Name, t.Data.Render(on, off, bar))
+	}
+	return fmt.Fprintf(w, "(%d) %s\t%s\n", t.ID, t.Name, t.Data.Render(on, off, bar))
+}
+
+// TextReader returns a reader of the text returned by String, rendered a
+// line at a time as it is read. p must not change until it is read.
+func (p *Pattern) TextReader() io.Reader {
+	return &textReader{p: p}
+}
+
+// textReader implements Pattern.TextReader.
+type textReader struct {
+	p    *Pattern
+	next int          // next line to render, 0 for the header
+	buf  bytes.Buffer // rendered, not yet read
+}
+
+func (r *textReader) Read(b []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		switch {
+		case r.next > len(r.p.Tracks):
+			return 0, io.EOF
+		case r.next == 0:
+			r.p.renderHeader(&r.buf)
+		default:
+			r.p.Tracks[r.next-1].render(&r.buf, 'x', '-', '|')
+		}
+		r.next++
+	}
+	return r.buf.Read(b)
+}
+
+// StringTempo returns the tempo rounded to one decimal place, hiding the
+// noise introduced by its float32 representation.
+func (p *Pattern) StringTempo() string {
+	t := math.Round(float64(p.Tempo)*10) / 10
+	return strconv.FormatFloat(t, 'f', -1, 64)
+}
+
+// ScaleTempo multiplies the tempo by factor, clamping it to the largest
+// float32. It fails with ErrInvalidTempo, leaving the tempo unchanged, if
+// the result isn't positive and finite.
+func (p *Pattern) ScaleTempo(factor float64) error {
+	t := float64(p.Tempo) * factor
+	if math.IsNaN(t) || math.IsInf(t, 0) {
+		return ErrInvalidTempo
+	}
+	if t > math.MaxFloat32 {
+		t = math.MaxFloat32
+	}
+	// Tiny results underflow to zero as float32.
+	if float32(t) <= 0 {
+		return ErrInvalidTempo
+	}
+	p.Tempo = float32(t)
+	return nil
+}
+
+// TrackIDs returns the IDs of the tracks in order.
+func (p *Pattern) TrackIDs() []int {
+	ids := make([]int, len(p.Tracks))
+	for i, t := range p.Tracks {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+// RemapIDs replaces the ID of every track with fn applied to it. It fails
+// with ErrDuplicateID, leaving the IDs unchanged, if the new IDs aren't
+// unique.
+func (p *Pattern) RemapIDs(fn func(old int) int) error {
+	ids := make([]int, len(p.Tracks))
+	seen := make(map[int]bool, len(p.Tracks))
+	for i, t := range p.Tracks {
+		id := fn(t.ID)
+		if seen[id] {
+			return ErrDuplicateID
+		}
+		seen[id] = true
+		ids[i] = id
+	}
+	for i, id := range ids {
+		p.Tracks[i].ID = id
+		p.Tracks[i].RawID = uint32(id)
+	}
+	return nil
+}
+
+// RemoveEmptyTracks removes the tracks never triggering their instrument
+// and returns how many were removed.
+func (p *Pattern) RemoveEmptyTracks() int {
+	kept := p.Tracks[:0]
+	for _, t := range p.Tracks {
+		if !t.IsEmpty() {
+			kept = append(kept, t)
+		}
+	}
+	n := len(p.Tracks) - len(kept)
+	p.Tracks = kept
+	return n
+}
+
+// SortTracks orders the tracks by ascending ID. The sort is stable: only
+// tracks sharing an ID keep their file order.
+func (p *Pattern) SortTracks() {
+	sort.SliceStable(p.Tracks, func(i, j int) bool {
+		return p.Tracks[i].ID < p.Tracks[j].ID
+	})
+}
+
+// QuantizeVelocity flattens the steps to on/off values: a step below
+// threshold becomes 0 and any other 1. Steps already 0 or 1 are kept, so a
+// pattern without velocities is left unchanged.
+func (p *Pattern) QuantizeVelocity(threshold byte) {
+	for i := range p.Tracks {
+		for j, v := range p.Tracks[i].Data {
+			if v <= 1 {
+				continue
+			}
+			if v < threshold {
+				p.Tracks[i].Data[j] = 0
+			} else {
+				p.Tracks[i].Data[j] = 1
+			}
+		}
+	}
+}
+
+// EachTrack calls fn on each track in order, stopping at and returning the
+// first error. fn may modify the track in place.
+func (p *Pattern) EachTrack(fn func(*Track) error) error {
+	for i := range p.Tracks {
+		if err := fn(&p.Tracks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Track is a single instrument of a pattern.
+type Track struct {
+	// ID identifies the track. The file stores unsigned 32-bit IDs, and
+	// on 32-bit platforms those of 1<<31 and above wrap to negative IDs.
+	ID int
+
+	// RawID is the unsigned ID stored in the file, set along with ID by
+	// the decoder and the methods of Pattern. It is encoded and printed
+	// as long as ID is its int conversion, so changing ID alone is
+	// enough.
+	RawID uint32 `json:"-"`
+
+	Name string
+	Data Steps
+
+	// Extra holds the trailer following the steps in the file variants
+	// selected by Options.TrackTrailer, nil otherwise.
+	Extra []byte `json:",omitempty"`
+}
+
+// storedID returns the ID stored in the file for t, and whether ID fits
+// one.
+func (t *Track) storedID() (uint32, bool) {
+	if t.ID == int(t.RawID) {
+		return t.RawID, true
+	}
+	if t.ID < 0 || int64(t.ID) > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(t.ID), true
+}
+
+// Equal reports whether t and other have the same ID, name and steps.
+func (t Track) Equal(other Track) bool {
+	return t.ID == other.ID && t.Name == other.Name && t.Data.Equal(other.Data)
+}
+
+// IsEmpty reports whether the track never triggers its instrument.
+func (t *Track) IsEmpty() bool {
+	return t.Data.Count() == 0
+}
+
+// Steps holds the state of each of the 16 steps of a track.
+// A non-zero value means the instrument is triggered on that step.
+type Steps [stepCount]byte
+
+// Equal reports whether s and other hold the same values.
+func (s Steps) Equal(other Steps) bool {
+	return s == other
+}
+
+// Count returns the number of steps triggering the instrument.
+func (s Steps) Count() int {
+	n := 0
+	for _, v := range s {
+		if v != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (s Steps) String() string {
+	return s.Render('x', '-', '|')
+}
+
+// Render draws the steps triggering the instrument as on, the others as
+// off, and separates the bars of four steps with bar.
+func (s Steps) Render(on, off, bar rune) string {
+	var buf bytes.Buffer
+	for i, v := range s {
+		if i%4 == 0 {
+			buf.WriteRune(bar)
+		}
+		if v != 0 {
+			buf.WriteRune(on)
+		} else {
+			buf.WriteRune(off)
+		}
+	}
+	buf.WriteRune(bar)
+	return buf.String()
+}
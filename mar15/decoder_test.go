@@ -1,8 +1,19 @@
 package drum
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +84,956 @@ Tempo: 999
 		}
 	}
 }
+
+func TestCountTracks(t *testing.T) {
+	tData := []struct {
+		path  string
+		count int
+	}{
+		{"pattern_1.splice", 6},
+		{"pattern_2.splice", 4},
+		{"pattern_3.splice", 6},
+		{"pattern_4.splice", 4},
+		{"pattern_5.splice", 2},
+	}
+
+	for _, exp := range tData {
+		n, err := CountTracks(path.Join("fixtures", exp.path))
+		if err != nil {
+			t.Fatalf("something went wrong counting %s - %v", exp.path, err)
+		}
+		if n != exp.count {
+			t.Fatalf("%s: got %d tracks, expected %d", exp.path, n, exp.count)
+		}
+	}
+}
+
+func TestStringTempo(t *testing.T) {
+	tData := []struct {
+		tempo  float32
+		output string
+	}{
+		{120, "120"},
+		{98.4, "98.4"},
+		{119.99998, "120"},
+		{240.04, "240"},
+		{0.25, "0.3"},
+	}
+
+	for _, exp := range tData {
+		p := &Pattern{Tempo: exp.tempo}
+		if got := p.StringTempo(); got != exp.output {
+			t.Fatalf("tempo %v: got %s, expected %s", exp.tempo, got, exp.output)
+		}
+	}
+}
+
+func TestStepsCount(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kick := decoded.Tracks[0]
+	if n := kick.Data.Count(); n != 4 {
+		t.Fatalf("%s: got %d steps, expected 4", kick.Name, n)
+	}
+
+	s := Steps{0: 1, 3: 127, 15: 255}
+	if n := s.Count(); n != 3 {
+		t.Fatalf("%v: got %d steps, expected 3", s, n)
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("pattern_%d.splice", i)
+		decoded, err := DecodeFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParsePattern(decoded.String())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if parsed.String() != decoded.String() {
+			t.Fatalf("%s wasn't parsed back.\nGot:\n%s\nExpected:\n%s", name, parsed, decoded)
+		}
+	}
+
+	p, err := ParsePattern("Saved with HW Version: 0.808\nTempo: 120\n(1) kick\t|X---|x---|----|----|\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Tracks[0].Data; s[0] <= s[4] || s[4] == 0 {
+		t.Fatalf("Unexpected accent levels: %v", s[:5])
+	}
+
+	bad := []struct {
+		text string
+		line int
+	}{
+		{"", 1},
+		{"Version: 1\nTempo: 120\n", 1},
+		{"Saved with HW Version: 1\nTempo: fast\n", 2},
+		{"Saved with HW Version: 1\nTempo: 120\n(1 kick\t|----|----|----|----|\n", 3},
+		{"Saved with HW Version: 1\nTempo: 120\n(a) kick\t|----|----|----|----|\n", 3},
+		{"Saved with HW Version: 1\nTempo: 120\n(1) kick |----|----|----|----|\n", 3},
+		{"Saved with HW Version: 1\nTempo: 120\n(1) kick\t|----|----|----|---|\n", 3},
+		{"Saved with HW Version: 1\nTempo: 120\n(1) kick\t|----|----|----|---o|\n", 3},
+		{"Saved with HW Version: 1\nTempo: 120\n(1) kick\t|--------|----|----|\n", 3},
+	}
+	for _, exp := range bad {
+		_, err := ParsePattern(exp.text)
+		perr, ok := err.(*ParseError)
+		if !ok || perr.Line != exp.line {
+			t.Fatalf("%q: got %v, expected an error on line %d", exp.text, err, exp.line)
+		}
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	paths := []string{
+		path.Join("fixtures", "pattern_1.splice"),
+		path.Join("fixtures", "missing.splice"),
+		path.Join("fixtures", "pattern_2.splice"),
+	}
+	var buf bytes.Buffer
+	if err := DumpJSON(&buf, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []struct {
+		File    string
+		Pattern *Pattern
+		Error   string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatalf("invalid JSON %s - %v", buf.Bytes(), err)
+	}
+	if len(entries) != len(paths) {
+		t.Fatalf("got %d entries, expected %d", len(entries), len(paths))
+	}
+	for i, e := range entries {
+		if e.File != paths[i] {
+			t.Fatalf("entry %d: got file %s, expected %s", i, e.File, paths[i])
+		}
+		if (e.Pattern == nil) != (i == 1) || (e.Error == "") != (i != 1) {
+			t.Fatalf("entry %d: unexpected pattern %v and error %q", i, e.Pattern, e.Error)
+		}
+	}
+	if decoded, _ := DecodeFile(paths[0]); fmt.Sprint(entries[0].Pattern) != fmt.Sprint(decoded) {
+		t.Fatalf("%s wasn't dumped as expected.\nGot:\n%s\nExpected:\n%s", paths[0], entries[0].Pattern, decoded)
+	}
+}
+
+func TestHumanize(t *testing.T) {
+	track := &Track{Name: "hh", Data: Steps{0: 1, 2: 1, 4: 1, 6: 1, 15: 1}}
+	steps := track.Data
+
+	hits := track.Humanize(0, 1)
+	if len(hits) != steps.Count() {
+		t.Fatalf("got %d hits, expected %d", len(hits), steps.Count())
+	}
+	for _, h := range hits {
+		if h.Time != float64(h.Step) || h.Level != 1 {
+			t.Fatalf("unexpected hit without humanizing: %+v", h)
+		}
+	}
+
+	hits = track.Humanize(0.5, 42)
+	moved := false
+	for _, h := range hits {
+		if d := h.Time - float64(h.Step); d < -0.25 || d > 0.25 {
+			t.Fatalf("hit moved too far: %+v", h)
+		} else if d != 0 {
+			moved = true
+		}
+	}
+	if !moved {
+		t.Fatal("no hit was moved")
+	}
+	if again := track.Humanize(0.5, 42); fmt.Sprint(again) != fmt.Sprint(hits) {
+		t.Fatalf("same seed, different timing: %v != %v", again, hits)
+	}
+	if track.Data != steps {
+		t.Fatal("the steps were modified")
+	}
+}
+
+func TestSwing(t *testing.T) {
+	track := &Track{Name: "hh", Data: Steps{0: 1, 1: 1, 2: 1, 3: 1}}
+	tData := []struct {
+		swing float64
+		times []float64
+	}{
+		{0, []float64{0, 1, 2, 3}},
+		{50, []float64{0, 1, 2, 3}},
+		{75, []float64{0, 1.5, 2, 3.5}},
+	}
+
+	for _, exp := range tData {
+		hits := track.Hits(RenderOptions{SwingPercent: exp.swing})
+		if len(hits) != len(exp.times) {
+			t.Fatalf("swing %v: got %d hits, expected %d", exp.swing, len(hits), len(exp.times))
+		}
+		for i, h := range hits {
+			if h.Time != exp.times[i] {
+				t.Fatalf("swing %v: step %d at %v, expected %v", exp.swing, h.Step, h.Time, exp.times[i])
+			}
+		}
+	}
+}
+
+func TestSoloMute(t *testing.T) {
+	p := NewPattern("0.808-alpha", 120).
+		WithTrack(0, "kick", "x---x---x---x---").
+		WithTrack(1, "snare", "----x-------x---").
+		WithTrack(2, "hh", "--x---x---x---x-")
+	tData := []struct {
+		opts    RenderOptions
+		playing string
+	}{
+		{RenderOptions{}, "kick snare hh"},
+		{RenderOptions{Mute: []int{1}}, "kick hh"},
+		{RenderOptions{Solo: []int{1, 2}}, "snare hh"},
+		{RenderOptions{Solo: []int{2}, Mute: []int{2}}, "hh"},
+	}
+	for _, exp := range tData {
+		var playing []string
+		for i := range p.Tracks {
+			if len(p.Tracks[i].Hits(exp.opts)) > 0 {
+				playing = append(playing, p.Tracks[i].Name)
+			}
+		}
+		if got := strings.Join(playing, " "); got != exp.playing {
+			t.Fatalf("%+v: got %q playing, expected %q", exp.opts, got, exp.playing)
+		}
+	}
+}
+
+func TestScaleTempo(t *testing.T) {
+	p := &Pattern{Tempo: 120}
+	if err := p.ScaleTempo(1.5); err != nil {
+		t.Fatal(err)
+	}
+	if p.Tempo != 180 {
+		t.Fatalf("got tempo %v, expected 180", p.Tempo)
+	}
+
+	for _, factor := range []float64{0, -1, 1e-60, math.NaN(), math.Inf(1)} {
+		if err := p.ScaleTempo(factor); err != ErrInvalidTempo {
+			t.Fatalf("factor %v: got %v, expected %v", factor, err, ErrInvalidTempo)
+		}
+	}
+	if p.Tempo != 180 {
+		t.Fatalf("tempo changed to %v on error", p.Tempo)
+	}
+	if err := p.ScaleTempo(math.MaxFloat64 / 1e10); err != nil || p.Tempo != math.MaxFloat32 {
+		t.Fatalf("got tempo %v and %v, expected the largest float32", p.Tempo, err)
+	}
+}
+
+func TestDecodeFileErrors(t *testing.T) {
+	tData := []struct {
+		path string
+		err  error
+	}{
+		{"empty.splice", ErrEmptyFile},
+		{"truncated_header.splice", io.ErrUnexpectedEOF},
+		{"long_name.splice", ErrInsufficientData},
+	}
+
+	for _, exp := range tData {
+		if _, err := DecodeFile(path.Join("fixtures", exp.path)); err != exp.err {
+			t.Fatalf("%s: got %v, expected %v", exp.path, err, exp.err)
+		}
+		if _, err := CountTracks(path.Join("fixtures", exp.path)); err != exp.err {
+			t.Fatalf("%s: counting got %v, expected %v", exp.path, err, exp.err)
+		}
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out.splice")
+
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("pattern_%d.splice", i)
+		p, err := DecodeFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := EncodeFile(out, p); err != nil {
+			t.Fatalf("%s: encoding: %v", name, err)
+		}
+		q, err := DecodeFile(out)
+		if err != nil {
+			t.Fatalf("%s: decoding the encoded pattern: %v", name, err)
+		}
+		if q.String() != p.String() {
+			t.Errorf("%s: round trip got\n%s\nexpected\n%s", name, q, p)
+		}
+	}
+
+	long := &Pattern{
+		Version: "0.808-alpha",
+		Tempo:   120,
+		Tracks:  []Track{{ID: 1, Name: strings.Repeat("kick", 100)}},
+	}
+	if err := EncodeFile(out, long); err != ErrFieldOverflow {
+		t.Fatalf("encoding a long name: got %v, expected %v", err, ErrFieldOverflow)
+	}
+	// The data length is a single byte whatever the name lengths.
+	opts := Options{LongNames: true}
+	if err := EncodeFileOptions(out, long, opts); err != ErrFieldOverflow {
+		t.Fatalf("encoding too much data: got %v, expected %v", err, ErrFieldOverflow)
+	}
+	long.Tracks[0].Name = strings.Repeat("kick", 40)
+	if err := EncodeFileOptions(out, long, opts); err != nil {
+		t.Fatal(err)
+	}
+	q, err := DecodeFileOptions(out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.String() != long.String() {
+		t.Errorf("long names round trip got\n%s\nexpected\n%s", q, long)
+	}
+}
+
+func TestEachTrack(t *testing.T) {
+	p, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := fmt.Sprint(p.TrackIDs()); ids != "[0 1 2 3 4 5]" {
+		t.Errorf("got IDs %s", ids)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = p.EachTrack(func(tr *Track) error {
+		if tr.ID == 2 {
+			return stop
+		}
+		tr.ID += 10
+		n++
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("got %v, expected %v", err, stop)
+	}
+	if ids := fmt.Sprint(p.TrackIDs()); n != 2 || ids != "[10 11 2 3 4 5]" {
+		t.Errorf("visited %d tracks, got IDs %s", n, ids)
+	}
+}
+
+func TestRemapIDs(t *testing.T) {
+	p, err := DecodeFile(path.Join("fixtures", "pattern_2.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fmt.Sprint(p.TrackIDs())
+
+	if err := p.RemapIDs(func(id int) int { return id / 2 }); err != ErrDuplicateID {
+		t.Fatalf("got %v, expected %v", err, ErrDuplicateID)
+	}
+	if ids := fmt.Sprint(p.TrackIDs()); ids != before {
+		t.Fatalf("failed remap changed IDs from %s to %s", before, ids)
+	}
+
+	if err := p.RemapIDs(func(id int) int { return id + 100 }); err != nil {
+		t.Fatal(err)
+	}
+	if ids := fmt.Sprint(p.TrackIDs()); ids != "[100 101 103 105]" {
+		t.Fatalf("got IDs %s", ids)
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	for i := 1; i <= 5; i++ {
+		name := path.Join("fixtures", fmt.Sprintf("pattern_%d.splice", i))
+		p, err := DecodeFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, tempo, err := DecodeHeader(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if version != p.Version || tempo != p.Tempo {
+			t.Errorf("%s: got %q %v, expected %q %v", name, version, tempo, p.Version, p.Tempo)
+		}
+	}
+
+	if _, _, err := DecodeHeader("decoder_test.go"); err != ErrInvalidFileFormat {
+		t.Fatalf("got %v, expected %v", err, ErrInvalidFileFormat)
+	}
+	if _, _, err := DecodeHeader(path.Join("fixtures", "empty.splice")); err != ErrEmptyFile {
+		t.Fatalf("got %v, expected %v", err, ErrEmptyFile)
+	}
+}
+
+func TestTrackEqual(t *testing.T) {
+	a := Track{ID: 1, Name: "kick", Data: Steps{1, 0, 0, 0, 1}}
+	tData := []struct {
+		b     Track
+		equal bool
+	}{
+		{a, true},
+		{Track{ID: 2, Name: "kick", Data: a.Data}, false},
+		{Track{ID: 1, Name: "snare", Data: a.Data}, false},
+		{Track{ID: 1, Name: "kick", Data: Steps{1, 0, 0, 0, 127}}, false},
+	}
+
+	for _, exp := range tData {
+		if eq := a.Equal(exp.b); eq != exp.equal {
+			t.Errorf("%v.Equal(%v) = %v, expected %v", a, exp.b, eq, exp.equal)
+		}
+		if eq := a.Data.Equal(exp.b.Data); eq != (a.Data == exp.b.Data) {
+			t.Errorf("%v.Equal(%v) = %v", a.Data, exp.b.Data, eq)
+		}
+	}
+}
+
+func TestRemoveEmptyTracks(t *testing.T) {
+	p := &Pattern{Tracks: []Track{
+		{ID: 0, Name: "kick", Data: Steps{1}},
+		{ID: 1, Name: "silent"},
+		{ID: 2, Name: "snare", Data: Steps{4: 1}},
+		{ID: 3, Name: "muted"},
+	}}
+	if !p.Tracks[1].IsEmpty() || p.Tracks[2].IsEmpty() {
+		t.Fatal("IsEmpty reports the wrong tracks")
+	}
+	if n := p.RemoveEmptyTracks(); n != 2 {
+		t.Fatalf("removed %d tracks, expected 2", n)
+	}
+	if ids := fmt.Sprint(p.TrackIDs()); ids != "[0 2]" {
+		t.Fatalf("got IDs %s, expected [0 2]", ids)
+	}
+	if n := p.RemoveEmptyTracks(); n != 0 {
+		t.Fatalf("removed %d tracks, expected none", n)
+	}
+}
+
+func TestSortTracks(t *testing.T) {
+	p := NewPattern("0.808-alpha", 120).
+		WithTrack(3, "hh", "--x---x---x---x-").
+		WithTrack(1, "kick", "x---x---x---x---").
+		WithTrack(3, "open", "x---------------").
+		WithTrack(2, "snare", "----x-------x---")
+	p.SortTracks()
+	var names []string
+	for _, tr := range p.Tracks {
+		names = append(names, tr.Name)
+	}
+	if got, exp := strings.Join(names, " "), "kick snare hh open"; got != exp {
+		t.Fatalf("got %s, expected %s", got, exp)
+	}
+}
+
+func TestQuantizeVelocity(t *testing.T) {
+	p := NewPattern("0.808-alpha", 120).
+		WithTrack(0, "kick", "x---x---x---x---").
+		WithTrack(1, "hh", "--x---x---x---x-")
+	binary := p.String()
+	p.QuantizeVelocity(64)
+	if p.String() != binary {
+		t.Fatalf("got\n%s\nexpected\n%s", p, binary)
+	}
+
+	p.Tracks[1].Data = Steps{0, 10, 64, 127, 1}
+	p.QuantizeVelocity(64)
+	if exp := (Steps{0, 0, 1, 1, 1}); p.Tracks[1].Data != exp {
+		t.Fatalf("got %v, expected %v", p.Tracks[1].Data[:], exp[:])
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	p, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := p.EncodedSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "drum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out.splice")
+	if err := EncodeFile(out, p); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(data) - binary.Size(header{}); got != n {
+		t.Fatalf("got %d bytes of data, expected %d", got, n)
+	}
+
+	p = NewPattern("0.808-alpha", 120)
+	for i := 0; i < 4; i++ {
+		p.WithTrack(i, strings.Repeat("long name ", 4), "x---x---x---x---")
+	}
+	if n, err := p.EncodedSize(); err != ErrFieldOverflow || n != 36+4*61 {
+		t.Fatalf("got %d, %v, expected %d, %v", n, err, 36+4*61, ErrFieldOverflow)
+	}
+}
+
+func TestRandomPattern(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		p := RandomPattern(r, 20)
+		if _, err := p.EncodedSize(); err != nil {
+			t.Fatalf("%v: %v", p, err)
+		}
+		if len(p.Version) > 32 || !(p.Tempo > 0) || len(p.Tracks) > 20 {
+			t.Fatalf("invalid pattern:\n%v", p)
+		}
+		seen := make(map[int]bool)
+		for _, id := range p.TrackIDs() {
+			if seen[id] {
+				t.Fatalf("duplicate ID %d:\n%v", id, p)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+// AssertRoundTrip encodes p, decodes it back and fails t unless the result
+// equals p.
+func AssertRoundTrip(t *testing.T, p *Pattern) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encode(&buf, p, Options{}); err != nil {
+		t.Fatalf("encoding\n%v: %v", p, err)
+	}
+	q, err := decode(&buf, Options{})
+	if err != nil {
+		t.Fatalf("decoding\n%v: %v", p, err)
+	}
+	eq := q.Version == p.Version && q.Tempo == p.Tempo && len(q.Tracks) == len(p.Tracks)
+	for i := 0; eq && i < len(p.Tracks); i++ {
+		eq = q.Tracks[i].Equal(p.Tracks[i])
+	}
+	if !eq {
+		t.Fatalf("got\n%v\nexpected\n%v", q, p)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{
+		"pattern_1.splice",
+		"pattern_2.splice",
+		"pattern_3.splice",
+		"pattern_4.splice",
+		"pattern_5.splice",
+	} {
+		p, err := DecodeFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		AssertRoundTrip(t, p)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		AssertRoundTrip(t, RandomPattern(r, 10))
+	}
+}
+
+func TestDecodeFiles(t *testing.T) {
+	var paths []string
+	for _, name := range []string{
+		"pattern_1.splice",
+		"empty.splice",
+		"pattern_2.splice",
+		"missing.splice",
+		"pattern_3.splice",
+	} {
+		paths = append(paths, path.Join("fixtures", name))
+	}
+	for _, concurrency := range []int{0, 1, 2, 10} {
+		patterns, errs := DecodeFiles(paths, concurrency)
+		for i, p := range paths {
+			exp, expErr := DecodeFile(p)
+			if (errs[i] == nil) != (expErr == nil) {
+				t.Fatalf("%d: %s: got error %v, expected %v", concurrency, p, errs[i], expErr)
+			}
+			if exp != nil && patterns[i].String() != exp.String() {
+				t.Fatalf("%d: %s: got\n%v\nexpected\n%v", concurrency, p, patterns[i], exp)
+			}
+		}
+	}
+}
+
+func TestStepsFromString(t *testing.T) {
+	for _, name := range []string{
+		"pattern_1.splice",
+		"pattern_2.splice",
+		"pattern_3.splice",
+		"pattern_4.splice",
+		"pattern_5.splice",
+	} {
+		p, err := DecodeFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tr := range p.Tracks {
+			s, err := StepsFromString(tr.Data.String())
+			if err != nil || s != tr.Data {
+				t.Fatalf("%s: %s: got %v, %v", name, tr.Name, s, err)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "x---x---x---x--", "x---x---x---x----", "x---x---x---x--o"} {
+		if _, err := StepsFromString(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestTempoFormat(t *testing.T) {
+	p := NewPattern("0.708-alpha", 98).
+		WithTrack(0, "kick", "x---x---x---x---")
+	opts := Options{TempoFormat: TempoUint16}
+	var buf bytes.Buffer
+	if err := encode(&buf, p, opts); err != nil {
+		t.Fatal(err)
+	}
+	classic, _ := p.EncodedSize()
+	if got := buf.Len() - binary.Size(header{}); got != classic-2 {
+		t.Fatalf("got %d bytes of data, expected %d", got, classic-2)
+	}
+	data := buf.Bytes()
+
+	q, err := decode(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.String() != p.String() {
+		t.Fatalf("got\n%s\nexpected\n%s", q, p)
+	}
+	// Read as a float, the tempo swallows the start of the track.
+	if q, err := decode(bytes.NewReader(data), Options{}); err == nil && q.String() == p.String() {
+		t.Fatal("the default format read the integer tempo")
+	}
+
+	p.Tempo = 98.4
+	if err := encode(&buf, p, opts); err != ErrFieldOverflow {
+		t.Fatalf("got %v, expected %v", err, ErrFieldOverflow)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out.splice")
+
+	p, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Checksum: true}
+	if err := EncodeFileOptions(out, p, opts); err != nil {
+		t.Fatal(err)
+	}
+	q, err := DecodeFileOptions(out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.String() != p.String() {
+		t.Fatalf("got\n%s\nexpected\n%s", q, p)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-checksumLen-1] ^= 1
+	if err := ioutil.WriteFile(out, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeFileOptions(out, opts); err != ErrChecksumMismatch {
+		t.Fatalf("got %v, expected %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestRender(t *testing.T) {
+	s := Steps{0: 1, 4: 1, 10: 127}
+	if got, exp := s.Render('●', '·', ' '), " ●··· ●··· ··●· ···· "; got != exp {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+
+	p := &Pattern{Version: "0.808-alpha", Tempo: 120, Tracks: []Track{{ID: 1, Name: "kick", Data: s}}}
+	exp := "Saved with HW Version: 0.808-alpha\nTempo: 120\n(1) kick\t:o...:o...:..o.:....:\n"
+	if got := p.Render('o', '.', ':'); got != exp {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+}
+
+func TestWithTrack(t *testing.T) {
+	p := NewPattern("0.808-alpha", 120).
+		WithTrack(0, "kick", "x---x---x---x---").
+		WithTrack(1, "snare", "----X-------X---")
+	exp := `Saved with HW Version: 0.808-alpha
+Tempo: 120
+(0) kick	|x---|x---|x---|x---|
+(1) snare	|----|x---|----|x---|
+`
+	if p.String() != exp {
+		t.Fatalf("got\n%s\nexpected\n%s", p, exp)
+	}
+	if p.Tracks[1].Data[4] != accentLevel {
+		t.Errorf("got level %d, expected an accent", p.Tracks[1].Data[4])
+	}
+
+	for _, steps := range []string{"x---", "x---x---x---x--o"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: expected a panic", steps)
+				}
+			}()
+			NewPattern("", 120).WithTrack(0, "kick", steps)
+		}()
+	}
+}
+
+func TestRawVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Hide bytes after the zero terminating the version.
+	data, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const versionOffset = 14
+	copy(data[versionOffset+len("0.808-alpha")+1:], "...")
+	in := filepath.Join(dir, "in.splice")
+	if err := ioutil.WriteFile(in, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := DecodeFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := data[versionOffset : versionOffset+32]
+	if p.Version != "0.808-alpha" || !bytes.Equal(p.RawVersion(), raw) {
+		t.Fatalf("got version %q and raw version %q", p.Version, p.RawVersion())
+	}
+
+	// The raw version survives encoding.
+	out := filepath.Join(dir, "out.splice")
+	if err := EncodeFile(out, p); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, data) {
+		t.Fatalf("got\n%q\nexpected\n%q", encoded, data)
+	}
+
+	p.Version = "0.909"
+	if exp := "0.909" + strings.Repeat("\x00", 27); string(p.RawVersion()) != exp {
+		t.Fatalf("got raw version %q, expected %q", p.RawVersion(), exp)
+	}
+}
+
+func TestDecodeAllProgress(t *testing.T) {
+	var bank bytes.Buffer
+	for i := 1; i <= 4; i++ {
+		data, err := ioutil.ReadFile(path.Join("fixtures", fmt.Sprintf("pattern_%d.splice", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bank.Write(data)
+	}
+	bank.WriteString("SPLICE")
+
+	var got []string
+	n, err := DecodeAllProgress(bytes.NewReader(bank.Bytes()), func(p *Pattern, index int) {
+		got = append(got, fmt.Sprintf("%d:%d", index, len(p.Tracks)))
+	})
+	if n != 4 || err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %d patterns and %v, expected 4 and %v", n, err, io.ErrUnexpectedEOF)
+	}
+	if s := fmt.Sprint(got); s != "[0:6 1:4 2:6 3:4]" {
+		t.Fatalf("got progress %s", s)
+	}
+
+	bank.Truncate(bank.Len() - len("SPLICE"))
+	patterns, err := DecodeAll(&bank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodeFile(path.Join("fixtures", "pattern_2.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 4 || patterns[1].String() != p.String() {
+		t.Fatalf("got %d patterns, the second being\n%v", len(patterns), patterns[1])
+	}
+}
+
+func TestPatternWriteTo(t *testing.T) {
+	p, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := p.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != p.String() || n != int64(buf.Len()) {
+		t.Fatalf("wrote %d bytes\n%s\nexpected\n%s", n, buf.String(), p)
+	}
+
+	// Writing stops at the first error.
+	w := &failingWriter{left: 2}
+	if _, err := p.WriteTo(w); err != io.ErrShortWrite || w.writes != 3 {
+		t.Fatalf("got %v after %d writes", err, w.writes)
+	}
+}
+
+// failingWriter fails once it has accepted left writes.
+type failingWriter struct {
+	left, writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.left == 0 {
+		return 0, io.ErrShortWrite
+	}
+	w.left--
+	return len(p), nil
+}
+
+func TestTextReader(t *testing.T) {
+	p, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small reads cross the lines.
+	var buf bytes.Buffer
+	if _, err := io.CopyBuffer(&buf, struct{ io.Reader }{p.TextReader()}, make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != p.String() {
+		t.Fatalf("got\n%s\nexpected\n%s", buf.String(), p)
+	}
+}
+
+func TestHighTrackID(t *testing.T) {
+	id := uint32(math.MaxUint32)
+	p := NewPattern("0.808-alpha", 120).
+		WithTrack(int(id), "kick", "x---x---x---x---")
+	if p.Tracks[0].RawID != id {
+		t.Fatalf("got raw ID %d, expected %d", p.Tracks[0].RawID, id)
+	}
+	AssertRoundTrip(t, p)
+	if line := strings.Split(p.String(), "\n")[2]; !strings.HasPrefix(line, "(4294967295) kick") {
+		t.Fatalf("got %q", line)
+	}
+}
+
+// stutterReader reads nothing, without an error, every other read.
+type stutterReader struct {
+	r       io.Reader
+	stutter bool
+}
+
+func (r *stutterReader) Read(p []byte) (int, error) {
+	if r.stutter = !r.stutter; r.stutter {
+		return 0, nil
+	}
+	return r.r.Read(p)
+}
+
+func TestStrictLength(t *testing.T) {
+	data, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := Options{StrictLength: true}
+	if _, err := decode(bytes.NewReader(data), strict); err != nil {
+		t.Fatal(err)
+	}
+
+	// Follow the data with more bytes.
+	surplus := append(append([]byte(nil), data...), 0, 0, 0, 0)
+	if _, err := decode(bytes.NewReader(surplus), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decode(bytes.NewReader(surplus), strict); err != ErrLengthMismatch {
+		t.Fatalf("got %v, expected %v", err, ErrLengthMismatch)
+	}
+	if _, err := decode(&stutterReader{r: bytes.NewReader(surplus)}, strict); err != ErrLengthMismatch {
+		t.Fatalf("got %v, expected %v", err, ErrLengthMismatch)
+	}
+
+	// Declare more data than the tracks hold.
+	data = append([]byte(nil), data...)
+	data[len(spliceMagic)+7] += 10
+	if _, err := decode(bytes.NewReader(data), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decode(bytes.NewReader(data), strict); err != ErrLengthMismatch {
+		t.Fatalf("got %v, expected %v", err, ErrLengthMismatch)
+	}
+}
+
+func TestTrackTrailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out.splice")
+
+	p := NewPattern("0.808-alpha", 120).
+		WithTrack(0, "kick", "x---x---x---x---").
+		WithTrack(1, "snare", "----x-------x---")
+	p.Tracks[0].Extra = []byte{0xff, 0, 0, 0xff}
+	opts := Options{TrackTrailer: 4}
+	if err := EncodeFileOptions(out, p, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := DecodeFileOptions(out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.String() != p.String() {
+		t.Fatalf("got\n%s\nexpected\n%s", q, p)
+	}
+	if !bytes.Equal(q.Tracks[0].Extra, p.Tracks[0].Extra) || !bytes.Equal(q.Tracks[1].Extra, make([]byte, 4)) {
+		t.Fatalf("got trailers %x and %x", q.Tracks[0].Extra, q.Tracks[1].Extra)
+	}
+
+	if err := EncodeFile(out, p); err != ErrFieldOverflow {
+		t.Fatalf("got %v, expected %v", err, ErrFieldOverflow)
+	}
+}
@@ -0,0 +1,44 @@
+package drum
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// dumpEntry is an element of the array written by DumpJSON.
+type dumpEntry struct {
+	File    string   `json:"file"`
+	Pattern *Pattern `json:"pattern,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// DumpJSON decodes the drum machine files found at paths and writes them
+// to w as a JSON array, one element per file holding its path and either
+// its pattern or its decoding error. Only errors writing to w are
+// returned.
+func DumpJSON(w io.Writer, paths []string) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, path := range paths {
+		e := dumpEntry{File: path}
+		p, err := DecodeFile(path)
+		if err != nil {
+			e.Error = err.Error()
+		} else {
+			e.Pattern = p
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b = append([]byte{','}, b...)
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
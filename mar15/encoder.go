@@ -0,0 +1,128 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// ErrFieldOverflow is returned when a pattern field doesn't fit in its
+// encoding, like a version string longer than 32 bytes.
+var ErrFieldOverflow = errors.New("drum: field overflows its encoding")
+
+// EncodeFile writes p as a drum machine file at the provided path.
+func EncodeFile(path string, p *Pattern) error {
+	return EncodeFileOptions(path, p, Options{})
+}
+
+// EncodeFileOptions is like EncodeFile for the format variant selected by
+// opts.
+func EncodeFileOptions(path string, p *Pattern, opts Options) error {
+	var buf bytes.Buffer
+	if err := encode(&buf, p, opts); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// EncodedSize returns the data length of p encoded in the classic format:
+// the version, the tempo and the tracks. The header holds it in a single
+// byte, so it fails with ErrFieldOverflow if the size, which is still
+// returned, exceeds 255 or if a field of p doesn't fit.
+func (p *Pattern) EncodedSize() (int, error) {
+	var info patternInfo
+	if len(p.Version) > len(info.Version) {
+		return 0, ErrFieldOverflow
+	}
+	n := binary.Size(info)
+	for _, t := range p.Tracks {
+		if _, ok := t.storedID(); !ok || len(t.Name) > math.MaxUint8 {
+			return 0, ErrFieldOverflow
+		}
+		n += 4 + 1 + len(t.Name) + stepCount
+	}
+	if n > math.MaxUint8 {
+		return n, ErrFieldOverflow
+	}
+	return n, nil
+}
+
+// encode writes p to w. The data is built first, for the header to hold
+// its length.
+func encode(w io.Writer, p *Pattern, opts Options) error {
+	var info patternInfo
+	if len(p.Version) > len(info.Version) {
+		return ErrFieldOverflow
+	}
+	copy(info.Version[:], p.RawVersion())
+	info.Tempo = p.Tempo
+
+	var data bytes.Buffer
+	if opts.TempoFormat == TempoUint16 {
+		// Only whole tempos fit.
+		tempo := uint16(p.Tempo)
+		if p.Tempo < 0 || p.Tempo > math.MaxUint16 || float32(tempo) != p.Tempo {
+			return ErrFieldOverflow
+		}
+		data.Write(info.Version[:])
+		binary.Write(&data, binary.LittleEndian, tempo)
+	} else {
+		binary.Write(&data, binary.LittleEndian, &info)
+	}
+	for _, t := range p.Tracks {
+		if err := writeTrack(&data, &t, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.Checksum {
+		var sum [checksumLen]byte
+		binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data.Bytes()))
+		data.Write(sum[:])
+	}
+
+	if data.Len() > math.MaxUint8 {
+		return ErrFieldOverflow
+	}
+	h := header{Magic: spliceMagic, DataLength: uint8(data.Len())}
+	if err := binary.Write(w, binary.BigEndian, &h); err != nil {
+		return err
+	}
+	_, err := w.Write(data.Bytes())
+	return err
+}
+
+// writeTrack appends the encoding of t to buf.
+func writeTrack(buf *bytes.Buffer, t *Track, opts Options) error {
+	maxName := math.MaxUint8
+	if opts.LongNames {
+		maxName = math.MaxUint16
+	}
+	stored, ok := t.storedID()
+	if !ok || len(t.Name) > maxName || len(t.Extra) > opts.TrackTrailer {
+		return ErrFieldOverflow
+	}
+
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], stored)
+	buf.Write(id[:])
+	if opts.LongNames {
+		var n [2]byte
+		binary.LittleEndian.PutUint16(n[:], uint16(len(t.Name)))
+		buf.Write(n[:])
+	} else {
+		buf.WriteByte(byte(len(t.Name)))
+	}
+	buf.WriteString(t.Name)
+	buf.Write(t.Data[:])
+	// A short trailer is padded with zero bytes.
+	buf.Write(t.Extra)
+	for i := len(t.Extra); i < opts.TrackTrailer; i++ {
+		buf.WriteByte(0)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package drum
+
+import "math/rand"
+
+// Hit is a step of a track triggering its instrument, as rendered for
+// export.
+type Hit struct {
+	Step  int
+	Level byte
+
+	// Time is the position of the hit in steps from the start of the
+	// pattern. It is Step unless humanized.
+	Time float64
+}
+
+// Humanize returns the hits of t with their timing randomly moved by up to
+// amount/2 steps earlier or later, amount being clamped to [0, 1] so that
+// every hit stays within its slot. The same seed always gives the same
+// timing. The steps of t are left untouched.
+func (t *Track) Humanize(amount float64, seed int64) []Hit {
+	if amount < 0 {
+		amount = 0
+	} else if amount > 1 {
+		amount = 1
+	}
+	r := rand.New(rand.NewSource(seed))
+	var hits []Hit
+	for i, v := range t.Data {
+		if v == 0 {
+			continue
+		}
+		jitter := (r.Float64()*2 - 1) * amount / 2
+		hits = append(hits, Hit{Step: i, Level: v, Time: float64(i) + jitter})
+	}
+	return hits
+}
@@ -0,0 +1,160 @@
+package drum
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	versionPrefix = "Saved with HW Version: "
+	tempoPrefix   = "Tempo: "
+)
+
+// Step levels used by ParsePattern. Any non-zero level triggers the
+// instrument.
+const (
+	hitLevel    = 1
+	accentLevel = 127
+)
+
+// ParseError reports a malformed line in the text given to ParsePattern.
+type ParseError struct {
+	Line int // 1-based line number
+	Text string
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("drum: line %d: %s: %q", e.Line, e.Msg, e.Text)
+}
+
+// ParsePattern parses a pattern in the format produced by Pattern.String.
+// An 'X' step is read as an accented hit.
+func ParsePattern(s string) (*Pattern, error) {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if !strings.HasPrefix(lines[0], versionPrefix) {
+		return nil, &ParseError{1, lines[0], "expected the version"}
+	}
+	p := &Pattern{Version: strings.TrimPrefix(lines[0], versionPrefix)}
+
+	if len(lines) < 2 {
+		return nil, &ParseError{2, "", "expected the tempo"}
+	}
+	if !strings.HasPrefix(lines[1], tempoPrefix) {
+		return nil, &ParseError{2, lines[1], "expected the tempo"}
+	}
+	tempo, err := strconv.ParseFloat(strings.TrimPrefix(lines[1], tempoPrefix), 32)
+	if err != nil {
+		return nil, &ParseError{2, lines[1], "invalid tempo"}
+	}
+	p.Tempo = float32(tempo)
+
+	for i, line := range lines[2:] {
+		t, msg := parseTrack(line)
+		if msg != "" {
+			return nil, &ParseError{i + 3, line, msg}
+		}
+		p.Tracks = append(p.Tracks, t)
+	}
+	return p, nil
+}
+
+// parseTrack parses a "(id) name\t|x---|...|" line, returning a message
+// describing the problem if it is malformed.
+func parseTrack(line string) (Track, string) {
+	var t Track
+	if !strings.HasPrefix(line, "(") {
+		return t, "expected a track"
+	}
+	end := strings.Index(line, ") ")
+	if end < 0 {
+		return t, "expected a track"
+	}
+	id, err := strconv.ParseUint(line[1:end], 10, 32)
+	if err != nil {
+		return t, "invalid track id"
+	}
+	t.ID, t.RawID = int(id), uint32(id)
+
+	rest := line[end+2:]
+	tab := strings.LastIndex(rest, "\t")
+	if tab < 0 {
+		return t, "missing steps"
+	}
+	t.Name = rest[:tab]
+	if len(t.Name) > 255 {
+		return t, "track name too long"
+	}
+
+	// Steps are grouped by four: |----|----|----|----|
+	steps := rest[tab+1:]
+	if len(steps) != stepCount+stepCount/4+1 {
+		return t, "invalid steps"
+	}
+	for i, j := 0, 0; i < len(steps); i++ {
+		c := steps[i]
+		if i%5 == 0 {
+			if c != '|' {
+				return t, "invalid steps"
+			}
+			continue
+		}
+		v, ok := parseStep(c)
+		if !ok {
+			return t, "invalid steps"
+		}
+		t.Data[j] = v
+		j++
+	}
+	return t, ""
+}
+
+// parseStep returns the level of a '-', 'x' or 'X' step.
+func parseStep(c byte) (byte, bool) {
+	switch c {
+	case '-':
+		return 0, true
+	case 'x':
+		return hitLevel, true
+	case 'X':
+		return accentLevel, true
+	}
+	return 0, false
+}
+
+// NewPattern returns an empty pattern, to be completed with WithTrack.
+func NewPattern(version string, tempo float32) *Pattern {
+	return &Pattern{Version: version, Tempo: tempo}
+}
+
+// WithTrack appends a track to p and returns p. steps is read by
+// StepsFromString, as in "x---x---x---x---". It panics if steps is
+// malformed, and is meant for literal patterns.
+func (p *Pattern) WithTrack(id int, name, steps string) *Pattern {
+	data, err := StepsFromString(steps)
+	if err != nil {
+		panic(err)
+	}
+	p.Tracks = append(p.Tracks, Track{ID: id, RawID: uint32(id), Name: name, Data: data})
+	return p
+}
+
+// StepsFromString parses one '-', 'x' or 'X' per step, ignoring any '|'.
+// It reads the output of Steps.String back, though every hit then has the
+// same level.
+func StepsFromString(s string) (Steps, error) {
+	var steps Steps
+	raw := strings.Replace(s, "|", "", -1)
+	if len(raw) != stepCount {
+		return steps, fmt.Errorf("drum: %q: expected %d steps", s, stepCount)
+	}
+	for i := 0; i < len(raw); i++ {
+		v, ok := parseStep(raw[i])
+		if !ok {
+			return steps, fmt.Errorf("drum: %q: invalid step %q", s, raw[i])
+		}
+		steps[i] = v
+	}
+	return steps, nil
+}
@@ -0,0 +1,46 @@
+package drum
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+// randomChars are the characters of the random versions and names.
+const randomChars = "abcdefghijklmnopqrstuvwxyz0123456789.-"
+
+// RandomPattern returns a pattern drawn from r, for testing: a version of
+// up to 32 characters, a positive tempo and up to maxTracks tracks with
+// unique IDs, short names and random steps. Fewer tracks are added if more
+// wouldn't fit the classic format, so the pattern can always be encoded.
+func RandomPattern(r *rand.Rand, maxTracks int) *Pattern {
+	var info patternInfo
+	p := NewPattern(randomString(r, r.Intn(len(info.Version)+1)), 1+r.Float32()*299)
+	size := binary.Size(info)
+	ids := r.Perm(256)
+	for i := 0; i < maxTracks && i < len(ids); i++ {
+		name := randomString(r, r.Intn(9))
+		size += 4 + 1 + len(name) + stepCount
+		if size > 255 {
+			break
+		}
+		t := Track{ID: ids[i], RawID: uint32(ids[i]), Name: name}
+		for j := range t.Data {
+			switch r.Intn(4) {
+			case 0:
+				t.Data[j] = hitLevel
+			case 1:
+				t.Data[j] = accentLevel
+			}
+		}
+		p.Tracks = append(p.Tracks, t)
+	}
+	return p
+}
+
+func randomString(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = randomChars[r.Intn(len(randomChars))]
+	}
+	return string(b)
+}
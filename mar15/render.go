@@ -0,0 +1,59 @@
+package drum
+
+// RenderOptions controls the timing of the hits rendered for export.
+type RenderOptions struct {
+	// SwingPercent delays every other step: the second step of each pair
+	// starts at SwingPercent percent of the pair. 50 is straight, about 66
+	// gives a triplet feel. Zero also means straight.
+	SwingPercent float64
+
+	// Solo, if not empty, holds the IDs of the only tracks playing.
+	// Otherwise every track plays but those whose ID is in Mute.
+	Solo []int
+	Mute []int
+}
+
+// plays reports whether the track with the given ID plays under opts.
+func (opts RenderOptions) plays(id int) bool {
+	if len(opts.Solo) > 0 {
+		return containsID(opts.Solo, id)
+	}
+	return !containsID(opts.Mute, id)
+}
+
+func containsID(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Hits returns the hits of t timed according to opts, none if opts
+// silences t. The steps of t are left untouched.
+func (t *Track) Hits(opts RenderOptions) []Hit {
+	if !opts.plays(t.ID) {
+		return nil
+	}
+	var hits []Hit
+	for i, v := range t.Data {
+		if v == 0 {
+			continue
+		}
+		hits = append(hits, Hit{Step: i, Level: v, Time: opts.stepTime(i)})
+	}
+	return hits
+}
+
+// stepTime returns the position in steps at which step i starts.
+func (opts RenderOptions) stepTime(i int) float64 {
+	if i%2 == 0 || opts.SwingPercent <= 0 {
+		return float64(i)
+	}
+	swing := opts.SwingPercent
+	if swing > 100 {
+		swing = 100
+	}
+	return float64(i-1) + 2*swing/100
+}